@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/hex"
+
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+// accountKinds labels each address seen in the calls of the block as a
+// `contract` or an `eoa` using only the traces of the block, addresses for
+// which the block tells nothing being labelled `unknown`.
+//
+// An address is a contract when it was created by a CREATE call, had its code
+// changed, executed code when called or was the caller of a nested call. It is
+// an externally owned account when it signed a transaction of the block, as
+// only those can.
+func accountKinds(block *pbcodec.Block) map[string]string {
+	kinds := map[string]string{}
+	label := func(address []byte, kind string) {
+		if len(address) == 0 {
+			return
+		}
+
+		key := "0x" + hex.EncodeToString(address)
+		if kinds[key] == "" || kinds[key] == "unknown" {
+			kinds[key] = kind
+		}
+	}
+
+	for _, trxTrace := range block.TransactionTraces {
+		label(trxTrace.From, "eoa")
+
+		for _, call := range trxTrace.Calls {
+			if call.CallType == pbcodec.CallType_CREATE || call.ExecutedCode {
+				label(call.Address, "contract")
+			}
+
+			if call.Depth > 0 {
+				label(call.Caller, "contract")
+			}
+
+			for _, change := range call.CodeChanges {
+				label(change.Address, "contract")
+			}
+
+			label(call.Caller, "unknown")
+			label(call.Address, "unknown")
+		}
+	}
+
+	return kinds
+}
+
+// transactionAccountKinds returns the kind of each address taking part in the
+// calls of the transaction, picked from the block wide kinds.
+func transactionAccountKinds(trxTrace *pbcodec.TransactionTrace, kinds map[string]string) map[string]string {
+	accounts := map[string]string{}
+	for _, call := range trxTrace.Calls {
+		for _, address := range [][]byte{call.Caller, call.Address} {
+			if len(address) == 0 {
+				continue
+			}
+
+			key := "0x" + hex.EncodeToString(address)
+			accounts[key] = kinds[key]
+		}
+	}
+
+	return accounts
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	dfuse "github.com/dfuse-io/client-go"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// getAPITokenInfo retrieves the StreamingFast API token, retrying on failure
+// up to maxAttempts times (0 meaning forever) like the stream does on errors.
+func getAPITokenInfo(ctx context.Context, client dfuse.Client, maxAttempts uint, breaker *authCircuitBreaker) (*dfuse.APITokenInfo, error) {
+	for attempt := uint(1); ; attempt++ {
+		tokenInfo, err := client.GetAPITokenInfo(ctx)
+		if err == nil || ctx.Err() != nil {
+			return tokenInfo, err
+		}
+		breaker.record(err)
+
+		if maxAttempts != 0 && attempt >= maxAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		zlog.Error("Unable to retrieve StreamingFast API token, going to retry", zap.Uint("attempt", attempt), zap.Duration("retry_delay", retryDelay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// authCircuitBreaker stops retrying once too many consecutive authentication
+// failures were seen, a revoked or invalid API key never recovering by itself
+// while retrying it forever could trigger rate limiting on the auth service.
+type authCircuitBreaker struct {
+	limit    uint
+	failures uint
+}
+
+// record accounts for the error, exiting the process when it's an
+// authentication failure and the limit of consecutive ones is reached. Other
+// errors are not accounted for but do not reset the count either.
+func (b *authCircuitBreaker) record(err error) {
+	if !isAuthFailure(err) {
+		return
+	}
+
+	b.failures++
+	if b.limit != 0 && b.failures >= b.limit {
+		quitWithCode(exitAuth, "Authentication failed %d consecutive times, giving up, check that your STREAMINGFAST_API_KEY is valid and has not been revoked: %s", b.failures, err)
+	}
+}
+
+func (b *authCircuitBreaker) reset() {
+	b.failures = 0
+}
+
+var authHTTPFailureRegex = regexp.MustCompile(`\(code (401|403)\)`)
+
+func isAuthFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return true
+	}
+
+	// The auth client reports rejected API keys as plain errors carrying the HTTP status code
+	return authHTTPFailureRegex.MatchString(err.Error())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+const supportedCodecVersion = 1
+
+var codecBlockTypeRegex = regexp.MustCompile(`^dfuse\.ethereum\.codec\.v(\d+)\.Block$`)
+
+// decodeBlock unmarshals the block payload, reporting a block encoded with
+// another version of the codec than the one this client supports with a clear
+// message instead of an obscure unmarshalling error.
+func decodeBlock(payload *any.Any) (*pbcodec.Block, error) {
+	name, err := ptypes.AnyMessageName(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block payload type: %w", err)
+	}
+
+	if match := codecBlockTypeRegex.FindStringSubmatch(name); match != nil {
+		version, _ := strconv.Atoi(match[1])
+		if version > supportedCodecVersion {
+			return nil, fmt.Errorf("block is encoded with codec v%d but this client only supports up to v%d, upgrade it to a version supporting %s", version, supportedCodecVersion, name)
+		}
+	}
+
+	block := &pbcodec.Block{}
+	if err := ptypes.UnmarshalAny(payload, block); err != nil {
+		return nil, fmt.Errorf("unmarshal block of type %q: %w", name, err)
+	}
+
+	return block, nil
+}
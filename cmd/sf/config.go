@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// effectiveConfig is the configuration actually used to stream, once flags,
+// environment variables and arguments have all been resolved.
+type effectiveConfig struct {
+	Endpoint    string   `json:"endpoint"`
+	Endpoints   []string `json:"endpoints,omitempty"`
+	AuthURL     string   `json:"auth_url"`
+	Filter      string   `json:"filter"`
+	StartBlock  int64    `json:"start_block"`
+	StopBlock   uint64   `json:"stop_block"`
+	StartCursor string   `json:"start_cursor"`
+	StartTime   string   `json:"start_time,omitempty"`
+	EndTime     string   `json:"end_time,omitempty"`
+	ForkSteps   []string `json:"fork_steps"`
+	Details     string   `json:"details"`
+	Output      string   `json:"output"`
+}
+
+func printConfig(endpoints []string, filter string, brange blockRange, cursor string) {
+	var forkSteps []string
+	for _, step := range requestedForkSteps() {
+		forkSteps = append(forkSteps, step.String())
+	}
+
+	config := effectiveConfig{
+		Endpoint:    endpoints[0],
+		AuthURL:     authURL,
+		Filter:      filter,
+		StartBlock:  brange.start,
+		StopBlock:   brange.end,
+		StartCursor: cursor,
+		StartTime:   *flagStartTime,
+		EndTime:     *flagEndTime,
+		ForkSteps:   forkSteps,
+		Details:     requestedDetails().String(),
+		Output:      outputPath(brange),
+	}
+
+	if len(endpoints) > 1 {
+		config.Endpoints = endpoints
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	noError(encoder.Encode(config), "unable to write effective configuration")
+}
+
+// configArgs are the keys of a --config file holding the positional arguments,
+// in the order they are expected on the command line.
+var configArgs = []string{"filter", "start_block", "end_block"}
+
+// loadConfigFile applies the settings of the YAML config file at path, JSON
+// being valid YAML, to the flags that were not explicitly set on the command
+// line. Keys are flag names (ex: "handle-forks", "o") along with "filter",
+// "start_block" and "end_block" for the positional arguments, which are
+// returned in the order of configArgs, empty when not set.
+func loadConfigFile(path string) []string {
+	content, err := ioutil.ReadFile(path)
+	noErrorWithCode(exitUsage, err, "unable to read config file %q", path)
+
+	var values map[string]interface{}
+	noErrorWithCode(exitUsage, yaml.Unmarshal(content, &values), "unable to decode config file %q", path)
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	positional := make([]string, len(configArgs))
+	for _, name := range names {
+		if index := indexOf(configArgs, name); index != -1 {
+			value, err := configValue(values[name])
+			noErrorWithCode(exitUsage, err, "invalid config file %q key %q", path, name)
+
+			positional[index] = value
+			continue
+		}
+
+		ensure(name != "config", "the config file %q cannot itself set key \"config\"", path)
+		ensure(flag.Lookup(name) != nil, "the config file %q key %q is not a known flag nor one of %q", path, name, configArgs)
+		if explicit[name] {
+			continue
+		}
+
+		entries, isList := values[name].([]interface{})
+		if !isList {
+			entries = []interface{}{values[name]}
+		}
+
+		for _, entry := range entries {
+			value, err := configValue(entry)
+			noErrorWithCode(exitUsage, err, "invalid config file %q key %q", path, name)
+			noErrorWithCode(exitUsage, flag.Set(name, value), "invalid config file %q key %q", path, name)
+		}
+	}
+
+	return positional
+}
+
+// mergeConfigArgs merges the positional arguments given on the command line
+// with the ones of the config file, in the order of configArgs, each argument
+// given on the command line taking precedence over the config file one.
+func mergeConfigArgs(args []string, configured []string) ([]string, error) {
+	merged := append([]string(nil), args...)
+	for i := len(args); i < len(configured); i++ {
+		merged = append(merged, configured[i])
+	}
+
+	for len(merged) > 0 && merged[len(merged)-1] == "" {
+		merged = merged[:len(merged)-1]
+	}
+
+	for i := 0; i < len(merged) && i < len(configArgs); i++ {
+		if merged[i] == "" {
+			return nil, fmt.Errorf("the %q argument is required by the following ones, set it in the config file or on the command line", configArgs[i])
+		}
+	}
+	return merged, nil
+}
+
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("expected a string, a number or a boolean, got %v", value)
+	}
+}
+
+func indexOf(values []string, value string) int {
+	for i, candidate := range values {
+		if candidate == value {
+			return i
+		}
+	}
+	return -1
+}
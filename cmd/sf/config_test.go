@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeConfigArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		configured    []string
+		expected      []string
+		expectedError string
+	}{
+		{"command line only", []string{"true", "100"}, nil, []string{"true", "100"}, ""},
+		{"config only", nil, []string{"true", "100", "200"}, []string{"true", "100", "200"}, ""},
+		{"config filter only", nil, []string{"true", "", ""}, []string{"true"}, ""},
+		{"nothing set", nil, []string{"", "", ""}, nil, ""},
+		{"filter from command line", []string{"false"}, []string{"true", "100", "200"}, []string{"false", "100", "200"}, ""},
+		{"range from config", []string{"true"}, []string{"", "100", "200"}, []string{"true", "100", "200"}, ""},
+		{"end block from config", []string{"true", "150"}, []string{"", "100", "200"}, []string{"true", "150", "200"}, ""},
+		{"command line overrides all", []string{"false", "1", "2"}, []string{"true", "100", "200"}, []string{"false", "1", "2"}, ""},
+
+		{"missing filter", nil, []string{"", "100", "200"}, nil, `the "filter" argument is required by the following ones, set it in the config file or on the command line`},
+		{"missing start block", []string{"true"}, []string{"", "", "200"}, nil, `the "start_block" argument is required by the following ones, set it in the config file or on the command line`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := mergeConfigArgs(test.args, test.configured)
+			if test.expectedError != "" {
+				if err == nil || err.Error() != test.expectedError {
+					t.Fatalf("expected error %q, got %v", test.expectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(actual) != 0 || len(test.expected) != 0 {
+				if !reflect.DeepEqual(actual, test.expected) {
+					t.Errorf("expected args %q, got %q", test.expected, actual)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+type pendingBlock struct {
+	response *pbbstream.BlockResponseV2
+	block    *pbcodec.Block
+	sampled  bool
+
+	// order is the state of the --verify-order verification once the block was
+	// checked, the one to restore when streaming restarts from its cursor
+	order orderVerifier
+}
+
+// confirmationBuffer holds back new blocks until the chain head, the highest
+// new block received, is at least `depth` blocks past them. Blocks are
+// released in the order they were received so the cursor of the last released
+// block is always safe to resume from.
+//
+// An undone block still held back is simply dropped along its undo, it was
+// never written so there is nothing to revert.
+type confirmationBuffer struct {
+	depth   uint64
+	head    uint64
+	pending []pendingBlock
+}
+
+// push adds the block to the buffer and returns the blocks that are now ready
+// to be written, in order.
+func (b *confirmationBuffer) push(p pendingBlock) (ready []pendingBlock) {
+	switch p.response.Step {
+	case pbbstream.ForkStep_STEP_NEW:
+		if p.block.Number > b.head {
+			b.head = p.block.Number
+		}
+
+	case pbbstream.ForkStep_STEP_UNDO:
+		b.head = p.block.Number - 1
+		for i := len(b.pending) - 1; i >= 0; i-- {
+			if b.pending[i].response.Step == pbbstream.ForkStep_STEP_NEW && b.pending[i].block.Number == p.block.Number {
+				b.pending = append(b.pending[:i], b.pending[i+1:]...)
+				return b.release()
+			}
+		}
+	}
+
+	b.pending = append(b.pending, p)
+	return b.release()
+}
+
+func (b *confirmationBuffer) release() (ready []pendingBlock) {
+	count := 0
+	for _, p := range b.pending {
+		if p.response.Step == pbbstream.ForkStep_STEP_NEW && p.block.Number+b.depth > b.head {
+			break
+		}
+		count++
+	}
+
+	ready = append(ready, b.pending[:count]...)
+	b.pending = b.pending[count:]
+	return ready
+}
+
+// drain returns all the blocks still held back, emptying the buffer
+func (b *confirmationBuffer) drain() (ready []pendingBlock) {
+	ready, b.pending = b.pending, nil
+	return ready
+}
+
+// reset forgets all the blocks held back, to be called when the stream
+// restarts from the cursor of the last released block.
+func (b *confirmationBuffer) reset() {
+	b.head = 0
+	b.pending = nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isCursorRejected tells if the stream error is the server refusing the start
+// cursor, which happens when it points to blocks the server no longer knows
+// about, typically after a long idle period.
+func isCursorRejected(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.OutOfRange:
+		return strings.Contains(strings.ToLower(status.Convert(err).Message()), "cursor")
+	}
+
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+var methodSelectorRegex = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{8}$`)
+var methodSignatureRegex = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*\([a-zA-Z0-9_,\[\]() ]*\)$`)
+
+// methodSelector resolves the 4-byte method selector, lower case hex encoded
+// with its `0x` prefix, from either a selector (`0xa9059cbb`) or a method
+// signature (`transfer(address,uint256)`) which is then hashed.
+func methodSelector(method string) (string, error) {
+	method = strings.TrimSpace(method)
+	if methodSelectorRegex.MatchString(method) {
+		return "0x" + strings.ToLower(strings.TrimPrefix(method, "0x")), nil
+	}
+
+	if methodSignatureRegex.MatchString(method) {
+		hash := sha3.NewLegacyKeccak256()
+		hash.Write([]byte(strings.ReplaceAll(method, " ", "")))
+
+		return "0x" + hex.EncodeToString(hash.Sum(nil)[0:4]), nil
+	}
+
+	return "", fmt.Errorf("method %q is neither a 4-byte hex selector (ex: 0xa9059cbb) nor a method signature (ex: transfer(address,uint256))", method)
+}
+
+var addressComparisonRegex = regexp.MustCompile(`\b(from|to|erc20_from|erc20_to)\s*(==|!=|in)\s*(\[[^\]]*\]|'[^']*'|"[^"]*")`)
+var quotedLiteralRegex = regexp.MustCompile(`'[^']*'|"[^"]*"`)
+var addressRegex = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// normalizeFilterAddresses lower cases the address literals compared to the
+// address fields of the filter (`from`, `to`, `erc20_from` and `erc20_to`),
+// the fields being lower case hex so a checksummed address would never match,
+// and returns the literals that are neither empty nor a `0x` prefixed 20-byte
+// hex address.
+func normalizeFilterAddresses(filter string) (normalized string, malformed []string) {
+	normalized = addressComparisonRegex.ReplaceAllStringFunc(filter, func(comparison string) string {
+		return quotedLiteralRegex.ReplaceAllStringFunc(comparison, func(literal string) string {
+			address := literal[1 : len(literal)-1]
+			if address == "" {
+				// Fields like erc20_to are empty when not applicable, a legit comparison
+				return literal
+			}
+
+			if !addressRegex.MatchString(address) {
+				malformed = append(malformed, address)
+				return literal
+			}
+
+			return literal[0:1] + strings.ToLower(address) + literal[len(literal)-1:]
+		})
+	})
+
+	return
+}
+
+var topicRegex = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{64}$`)
+
+// topicSet decodes the 32-byte hex encoded event topics (ex: the ERC20
+// `Transfer(address,address,uint256)` topic `0xddf252ad...`) into a set keyed
+// by the raw topic bytes.
+func topicSet(topics []string) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, topic := range topics {
+		topic = strings.TrimSpace(topic)
+		if !topicRegex.MatchString(topic) {
+			return nil, fmt.Errorf("topic %q is not a 32-byte hex value (ex: 0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef)", topic)
+		}
+
+		raw, _ := hex.DecodeString(strings.TrimPrefix(topic, "0x"))
+		set[string(raw)] = true
+	}
+
+	return set, nil
+}
+
+var filterVarRegex = regexp.MustCompile(`\$([a-zA-Z_][a-zA-Z0-9_]*)`)
+var filterVarNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// expandFilterVars replaces each `$NAME` placeholder of the filter by the value
+// of the matching `NAME=value` definition of vars, a placeholder without any
+// definition is an error.
+func expandFilterVars(filter string, vars []string) (string, error) {
+	values := map[string]string{}
+	for _, definition := range vars {
+		parts := strings.SplitN(definition, "=", 2)
+		if len(parts) != 2 || !filterVarNameRegex.MatchString(parts[0]) {
+			return "", fmt.Errorf("variable definition %q is invalid, expected NAME=value (ex: ROUTER=0x7a250d5630b4cf539739df2c5dacb4c659f2488d)", definition)
+		}
+
+		values[parts[0]] = parts[1]
+	}
+
+	var unresolved []string
+	expanded := filterVarRegex.ReplaceAllStringFunc(filter, func(placeholder string) string {
+		value, found := values[placeholder[1:]]
+		if !found {
+			unresolved = append(unresolved, placeholder)
+			return placeholder
+		}
+		return value
+	})
+
+	if len(unresolved) > 0 {
+		return "", fmt.Errorf("placeholders %s have no value, define them using --var NAME=value", strings.Join(unresolved, ", "))
+	}
+
+	return expanded, nil
+}
+
+// loadFilterFile reads the filter expression from the file at path, lines
+// starting with `#` or `//` are comments and the remaining lines are joined
+// so the expression can be formatted over multiple lines.
+func loadFilterFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		parts = append(parts, line)
+	}
+
+	if len(parts) == 0 {
+		return "", fmt.Errorf("file %q does not contain any filter expression", path)
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// andFilter combines the two CEL filter expressions so both must match
+func andFilter(filter string, condition string) string {
+	return fmt.Sprintf("(%s) && %s", filter, condition)
+}
+
+// traceFilterMatches logs, for each transaction the server returned as matching
+// the filter, all its calls and ERC20 transfer events, the fields the CEL filter
+// matches on (`from`, `to`, `input`, `erc20_from`, `erc20_to`). This is really
+// verbose and must only be called when trace logging is enabled.
+func traceFilterMatches(block *pbcodec.Block) {
+	for _, trxTrace := range block.TransactionTraces {
+		trxID := hex.EncodeToString(trxTrace.Hash)
+		zlog.Debug("Transaction matched filter", zap.Uint64("block_num", block.Number), zap.String("trx_id", trxID), zap.Int("call_count", len(trxTrace.Calls)))
+
+		for _, call := range trxTrace.Calls {
+			zlog.Debug("Transaction call",
+				zap.String("trx_id", trxID),
+				zap.Uint32("call_index", call.Index),
+				zap.Uint32("depth", call.Depth),
+				zap.Stringer("call_type", call.CallType),
+				zap.String("from", "0x"+hex.EncodeToString(call.Caller)),
+				zap.String("to", "0x"+hex.EncodeToString(call.Address)),
+			)
+
+			for _, event := range call.Erc20TransferEvents {
+				zlog.Debug("Transaction call ERC20 transfer",
+					zap.String("trx_id", trxID),
+					zap.Uint32("call_index", call.Index),
+					zap.String("erc20_from", "0x"+hex.EncodeToString(event.From)),
+					zap.String("erc20_to", "0x"+hex.EncodeToString(event.To)),
+				)
+			}
+		}
+	}
+}
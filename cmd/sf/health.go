@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"go.uber.org/zap"
+)
+
+// healthChecker reports the stream as healthy as long as a block was received
+// recently enough, the process being alive is not enough.
+type healthChecker struct {
+	maxDelay time.Duration
+
+	lock         sync.Mutex
+	lastBlockRef bstream.BlockRef
+	lastBlockAt  time.Time
+}
+
+func newHealthChecker(maxDelay time.Duration) *healthChecker {
+	return &healthChecker{maxDelay: maxDelay, lastBlockRef: bstream.BlockRefEmpty}
+}
+
+func (h *healthChecker) recordBlock(ref bstream.BlockRef) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastBlockRef = ref
+	h.lastBlockAt = time.Now()
+}
+
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	lastBlockRef, lastBlockAt := h.lastBlockRef, h.lastBlockAt
+	h.lock.Unlock()
+
+	if lastBlockAt.IsZero() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "no block received yet")
+		return
+	}
+
+	elapsed := time.Since(lastBlockAt)
+	if elapsed > h.maxDelay {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "last block %s received %s ago\n", lastBlockRef, elapsed)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "ok, last block %s received %s ago\n", lastBlockRef, elapsed)
+}
+
+// serveHealth starts serving the `/healthz` endpoint on the given address in
+// the background, failing right away if the address cannot be listened on.
+func serveHealth(addr string, checker *healthChecker) {
+	listener, err := net.Listen("tcp", addr)
+	noError(err, "unable to listen for health checks on %q", addr)
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", checker)
+
+	zlog.Info("Serving health checks", zap.String("listen_addr", addr))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			zlog.Error("Health check server stopped", zap.Error(err))
+		}
+	}()
+}
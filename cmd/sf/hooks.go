@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+)
+
+// runFirstBlockCommand runs the shell command in the background, its output
+// going to standard error. The block is exposed to the command through the
+// SF_BLOCK_NUM and SF_BLOCK_ID environment variables. Failures are only
+// logged, they never stop the stream.
+func runFirstBlockCommand(command string, block *pbcodec.Block) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "SF_BLOCK_NUM="+strconv.FormatUint(block.Number, 10), "SF_BLOCK_ID="+block.ID())
+
+	go func() {
+		if err := cmd.Run(); err != nil {
+			zlog.Warn("First block command failed", zap.String("command", command), zap.Error(err))
+			return
+		}
+
+		zlog.Info("First block command completed", zap.String("command", command))
+	}()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+// explorerTransactionURLs returns the base URLs, to which the `0x` prefixed
+// transaction hash is appended, of the block explorers for the network
+// selected through the network flags, Ethereum Mainnet otherwise.
+func explorerTransactionURLs() []string {
+	switch {
+	case *flagBSC:
+		return []string{"https://bscscan.com/tx/"}
+	case *flagPolygon:
+		return []string{"https://polygonscan.com/tx/"}
+	case *flagHECO:
+		return []string{"https://hecoinfo.com/tx/"}
+	case *flagFantom:
+		return []string{"https://ftmscan.com/tx/"}
+	case *flagOptimism:
+		return []string{"https://optimistic.etherscan.io/tx/"}
+	case *flagAvalanche:
+		return []string{"https://snowtrace.io/tx/"}
+	default:
+		return []string{"https://ethq.app/tx/", "https://etherscan.io/tx/"}
+	}
+}
+
+// printTransactionLinks prints to standard error the hash of each transaction
+// of the block along the explorer links to inspect it, nothing is printed for
+// a STEP_UNDO.
+func printTransactionLinks(response *pbbstream.BlockResponseV2, block *pbcodec.Block, baseURLs []string) {
+	if response.Step == pbbstream.ForkStep_STEP_UNDO {
+		return
+	}
+
+	for _, trxTrace := range block.TransactionTraces {
+		hash := "0x" + hex.EncodeToString(trxTrace.Hash)
+
+		printf("Block #%d transaction %s\n", block.Number, hash)
+		for _, baseURL := range baseURLs {
+			printf("  %s%s\n", baseURL, hash)
+		}
+	}
+}
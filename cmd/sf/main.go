@@ -4,32 +4,32 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
+	"math/big"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/dfuse-io/bstream"
 	dfuse "github.com/dfuse-io/client-go"
 	"github.com/dfuse-io/dgrpc"
-	"github.com/dfuse-io/jsonpb"
 	"github.com/dfuse-io/logging"
 	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
 	"github.com/golang/protobuf/ptypes"
-	"github.com/paulbellamy/ratecounter"
 	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/encoding/gzip"
 )
 
+var authURL = "https://auth.dfuse.io/v1/auth"
 var retryDelay = 5 * time.Second
 var statusFrequency = 15 * time.Second
 var traceEnabled = logging.IsTraceEnabled("consumer", "github.com/streamingfast/streamingfast-client")
@@ -37,28 +37,262 @@ var zlog = logging.NewSimpleLogger("consumer", "github.com/streamingfast/streami
 
 var flagEndpoint = flag.String("e", "api.streamingfast.io:443", "The endpoint to connect the stream of blocks to")
 
+var flagEndpoints = stringSliceFlag("endpoint", "The endpoint to connect the stream of blocks to, can be repeated in which case each reconnection rotates to the next endpoint, takes precedence over -e and network flags")
+
 var flagBSC = flag.Bool("bsc", false, "When set, will force the endpoint to Binance Smart Chain")
 var flagPolygon = flag.Bool("polygon", false, "When set, will force the endpoint to Polygon (previously Matic)")
 var flagHECO = flag.Bool("heco", false, "When set, will force the endpoint to Huobi Eco Chain")
 var flagFantom = flag.Bool("fantom", false, "When set, will force the endpoint to Fantom Opera Mainnet")
+var flagOptimism = flag.Bool("optimism", false, "When set, will force the endpoint to Optimism Mainnet")
+var flagAvalanche = flag.Bool("avalanche", false, "When set, will force the endpoint to Avalanche C-Chain")
 
-var flagHandleForks = flag.Bool("handle-forks", false, "Request notifications type STEP_UNDO when a block was forked out, and STEP_IRREVERSIBLE after a block has seen enough confirmations (200)")
+var flagHandleForks = flag.Bool("handle-forks", false, "Request notifications type STEP_UNDO when a block was forked out, and STEP_IRREVERSIBLE after a block has seen enough confirmations (200, defined by the server, not configurable), a STEP_UNDO is written as an undo record instead of the full block")
 var flagSkipVerify = flag.Bool("s", false, "When set, skips certification verification")
-var flagWrite = flag.String("o", "-", "When set, write each block as one JSON line in the specified file, value '-' writes to standard output otherwise to a file, {range} is replaced by block range in this case")
+var flagWrite = flag.String("o", "-", "When set, write each block as one JSON line in the specified file, value '-' writes to standard output otherwise to a file, {range} is replaced by block range and {time} by the UTC time the file was opened at in this case")
 var flagStartCursor = flag.String("start-cursor", "", "Last cursor used to continue where you left off")
+var flagOnlySuccessful = flag.Bool("only-successful", false, "When set, transactions that did not succeed (failed or reverted) are removed from blocks before being written")
+var flagSplitByBlock = flag.Bool("split-by-block", false, "When set, the -o flag is a directory in which each block is written in its own '<block_number>.json' file, blocks without any matching transactions are skipped")
+var flagHealthListen = flag.String("health-listen", "", "When set, serves on this address (ex: :8080) an HTTP '/healthz' endpoint returning 200 if a block was received within twice the status frequency, 503 otherwise")
+var flagTokenRetry = flag.Uint("token-retry", 0, "Maximum number of consecutive attempts at retrieving the StreamingFast API token before giving up, retried with the same delay as stream reconnections, 0 retries forever")
+var flagSampleRate = flag.Float64("sample-rate", 1.0, "Fraction (0.0 exclusive to 1.0) of the received blocks that are processed and written, other blocks are skipped while the cursor still advances, the decision being the same for all fork steps of a given block")
+var flagStallTimeout = flag.Duration("stall-timeout", 0, "When set, logs a warning when no block was received for this duration while the stream is still connected, 0 disables stall detection")
+var flagStallReconnect = flag.Bool("stall-reconnect", false, "When set along --stall-timeout, forces a reconnection of the stream when it appears stalled")
+var flagProxy = flag.String("proxy", "", "When set, connects through this proxy, either 'http://[user:password@]host:port' or 'socks5://[user:password@]host:port', unset honors the HTTPS_PROXY environment variable")
+var flagPrintConfig = flag.Bool("print-config", false, "When set, prints the effective configuration resolved from flags, environment variables and arguments as JSON to standard output and exits")
+var flagThenFollow = flag.Bool("then-follow", false, "When set, once the <end_block> of the range is reached, continues streaming from there following the chain head forever")
+var flagMinAmount = flag.String("min-amount", "", "When set, transactions without at least one ERC20 transfer event of this amount or more, in the token base units (ex: 1000000000000000000 for 1 token of 18 decimals), are removed from the blocks before they are written, dropping dust transfers")
+var flagResumeFromBlock = flag.String("resume-from-block", "", "When set, discards --start-cursor if any and streams from this block number forever, useful when a cursor became invalid")
+var flagTail = flag.Uint64("tail", 0, "When set, starts streaming this number of blocks behind the chain head and follows it forever, same as using -<N> as <start_block>")
+var flagBufferSize = flag.Int("buffer-size", 0, "When set, buffers the output using a buffer of this size in bytes, flushed at each progress status, on exit and following --flush-every, a terminal output is still flushed after each block, 0 writes each block unbuffered")
+var flagS3Bucket = flag.String("s3-bucket", "", "When set, blocks are uploaded to an object of this S3 bucket instead of being written locally, the object is named after the -o file name ('blocks-{range}.jsonl' when writing to standard output) and credentials come from the standard AWS environment variables")
+var flagS3Prefix = flag.String("s3-prefix", "", "Prefix (ex: 'backfill/eth') prepended to the S3 object key when --s3-bucket is set")
+var flagS3Endpoint = flag.String("s3-endpoint", "", "Custom endpoint (ex: 'http://localhost:9000') of an S3 compatible object store when --s3-bucket is set, uses AWS S3 when unset")
+var flagJSONStats = flag.Bool("json-stats", false, "When set, the final summary is printed as a single JSON object instead of human readable lines")
+var flagMethod = flag.String("method", "", "When set, only matches calls to this method, either a 4-byte selector (ex: 0xa9059cbb) or a method signature (ex: 'transfer(address,uint256)'), combined with <filter> using a logical AND")
+var flagMaxBytes = flag.Uint64("max-bytes", 0, "When set, stops streaming once at least this amount of bytes was received, the last block being fully written, 0 means no limit")
+var flagStartTime = flag.String("start-time", "", "When set, starts streaming at the first block produced at or after this RFC3339 timestamp (ex: 2021-01-27T21:58:38Z), in place of <start_block>")
+var flagEndTime = flag.String("end-time", "", "When set along --start-time, stops streaming at the last block produced at or before this RFC3339 timestamp, in place of <end_block>")
+var flagAuthFailureLimit = flag.Uint("auth-failure-limit", 3, "Number of consecutive authentication failures (API key or token rejected) after which the process exits instead of retrying, 0 retries forever")
+var flagDelimiter = flag.String("delimiter", "lf", "Separator written after each record, one of 'lf' (\\n), 'crlf' (\\r\\n) or 'nul' (\\0, for 'xargs -0' like consumers)")
+var flagNoVerify = flag.Bool("no-verify", false, "When set, skips verifying at the end of the run that the output file contains as many records as were written")
+var flagShutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "Maximum duration allowed for flushing and closing the output on exit, the process exits with an error once elapsed, 0 waits forever")
+var flagPretty = flag.Bool("pretty", false, "When set, each block is written as indented JSON spanning multiple lines instead of a single JSON line, for inspecting blocks interactively, disables the output record count verification")
+var flagConfig = flag.String("config", "", "When set, reads settings from this YAML file, or JSON being valid YAML, whose keys are flag names (ex: handle-forks: true) along with \"filter\", \"start_block\" and \"end_block\" for the arguments, flags and arguments given on the command line take precedence")
+var flagNoRetry = flag.Bool("no-retry", false, "When set, exits with an error on the first stream error instead of reconnecting, reaching the end of the range still completes successfully")
+var flagHeartbeat = flag.Duration("heartbeat", 0, "When set, writes a heartbeat record with the last received block and cursor to the output at most once per this duration as blocks are received, distinguishing a healthy but quiet stream from a stalled one, 0 disables heartbeats")
+var flagMaxCallDepth = flag.Int("max-call-depth", -1, "When set, calls nested deeper than this depth are removed from each transaction before the block is written, 0 keeping only the root call of each transaction, -1 keeps all calls")
+var flagTopics = stringSliceFlag("topic", "When set, only transactions with at least one log whose first topic is this 32-byte hex event signature hash (ex: 0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef for ERC20 Transfer) are kept in written blocks, can be repeated to match any of the topics")
+var flagCPUProfile = flag.String("cpuprofile", "", "When set, writes a pprof CPU profile of the whole run to this file")
+var flagMemProfile = flag.String("memprofile", "", "When set, writes a pprof heap profile taken at the end of the run to this file")
+var flagVars = stringSliceFlag("var", "Defines a NAME=value variable replacing each $NAME placeholder of the <filter> (ex: --var ROUTER=0x7a25... with filter \"to == '$ROUTER'\"), can be repeated, a placeholder without value is an error")
+var flagGRPCCompression = flag.Bool("grpc-compression", false, "When set, requests gzip compression of the gRPC messages, reducing the bandwidth used by full blocks at the expense of CPU on both ends")
+var flagSummaryOnly = flag.Bool("summary-only", false, "When set, blocks are not written anywhere and only warnings and errors are logged, leaving only the final summary, useful to estimate the volume of a range")
+var flagMaxRecvMsgSize = flag.Int("max-recv-msg-size", 100*1024*1024, "Maximum size in bytes of a single received gRPC message, a block bigger than this fails the stream with a 'ResourceExhausted' error")
+var formats = []string{"block", "trx-json", "storage-changes", "native-transfers", "headers", "proto-stream"}
+var flagFormat = flag.String("format", "block", "Format of the written records, 'block' writes each block as one JSON line, 'trx-json' writes each matching transaction trace as one JSON line along the block it belongs to, 'storage-changes' writes each storage slot change (key, old and new value) of the calls as one JSON line, 'native-transfers' writes each call transferring a non-zero native value (ex: ETH) as one JSON line with its from, to and value in wei, 'headers' requests light blocks and writes '<block_number> <block_id> <timestamp>' text lines followed by the step when --handle-forks is set, 'proto-stream' writes each matching transaction trace as a binary protobuf message prefixed by its varint encoded length (see README), a STEP_UNDO of the JSON formats still writing a single undo record for the block")
+var flagReorgSafe = flag.Bool("reorg-safe", false, "When set, only requests STEP_IRREVERSIBLE notifications so each block is written once it became irreversible and is never undone, at the cost of lagging behind the chain head by the confirmation depth")
+var flagPrintLinks = flag.Bool("print-links", false, "When set, prints to standard error the hash of each written transaction along links to inspect it on the block explorers of the network, useful while developing a filter")
+var flagWriteRate = flag.Float64("write-rate", 0, "When set, limits the amount of records written per second, blocking the stream while waiting so a slow downstream consumer is not overrun, 0 means no limit")
+var flagWebhookURL = flag.String("webhook-url", "", "When set, records are POSTed by batches as a JSON array to this URL instead of being written locally, a batch is retried on network errors and 5xx responses then dropped, logging an error, if it still fails")
+var flagWebhookBatchSize = flag.Int("webhook-batch-size", 100, "Maximum number of records POSTed at once when --webhook-url is set, the last partial batch being POSTed on exit")
+var flagCursorFallback = flag.Bool("cursor-fallback", false, "When set, a start cursor rejected by the server (ex: too old) is abandoned and streaming restarts from --fallback-block instead of retrying the cursor forever")
+var flagFallbackBlock = flag.String("fallback-block", "", "Block number, negative being relative to the chain head, streaming restarts from when --cursor-fallback is set and the start cursor gets rejected")
+var flagPubsubProject = flag.String("pubsub-project", "", "When set along --pubsub-topic, records are published as messages, with a 'block_num' attribute, to this Google Cloud project's Pub/Sub topic instead of being written locally, using the application default credentials, messages are published by batches, on each status log and on exit")
+var flagPubsubTopic = flag.String("pubsub-topic", "", "Pub/Sub topic, in the --pubsub-project project, to publish records to")
+var flagVerifyOrder = flag.Bool("verify-order", false, "When set along --handle-forks, exits with an error if a block is received out of order, new blocks must have increasing numbers, an undone block must be the current head and irreversible blocks must have increasing numbers")
+var flagMinConfirmations = flag.Uint64("min-confirmations", 0, "When set along --handle-forks, holds back each new block until the chain head is at least this number of blocks past it before writing it, an undone block held back being dropped instead, adds that many blocks of latency, blocks still held back are written once an end of range is reached, 0 writes blocks right away")
+var flagCompactTrace = flag.Bool("compact-trace", false, "When set, the inputs and logs of transactions and calls along the storage changes of calls are removed from blocks before they are written, matching on --topic still seeing the logs")
+var flagStatsFile = flag.String("stats-file", "", "When set, appends to this file at each progress status a JSON line holding the timestamp, last block number, blocks and bytes per second along the totals and the restart count")
+var flagOnFirstBlock = flag.String("on-first-block", "", "When set, runs this shell command in the background once the first block is received, with SF_BLOCK_NUM and SF_BLOCK_ID set in its environment, a failure of the command is logged without stopping the stream")
+var flagAppend = flag.Bool("append", false, "When set, records are appended to the -o file if it already exists instead of truncating it, useful to accumulate consecutive runs into a single file")
+var flagBlockTimeout = flag.Duration("block-timeout", 0, "When set, reconnects the stream when waiting for the next block takes longer than this duration, the wait for the first block of each connection not being bounded, 0 disables it")
+var flagAddressStats = flag.Bool("address-stats", false, "When set, counts the written transactions by the address they were sent to and adds the breakdown, busiest address first, to the final summary")
+var flagServiceConfig = flag.String("service-config", "", "When set, applies this gRPC service config JSON document to connections, 'retry' using a built-in policy retrying the stream establishment on UNAVAILABLE with backoff, retry policies also require the GRPC_GO_RETRY=on environment variable")
+var flagFilterFile = flag.String("filter-file", "", "When set, reads the filter expression from this file in place of the <filter> argument, lines starting with '#' or '//' being comments and the other lines being joined")
+var flagStopBlock = flag.Uint64("stop-block", 0, "When set, stops streaming after this block (inclusively), in place of the <end_block> argument, the only way to bound a stream resuming from --start-cursor")
+var flagSequence = flag.Bool("sequence", false, "When set, each record is prefixed by its sequence number, starting at 1 and increasing across reconnections for the whole run, followed by a tab")
+var flagAnnotateContracts = flag.Bool("annotate-contracts", false, "When set, the addresses of the 'trx-json' and 'native-transfers' records are labelled 'contract', 'eoa' or 'unknown' using only the traces of the block, no external calls are made")
+var flagMaxTrxsPerBlock = flag.Int("max-trxs-per-block", 0, "When greater than 0, blocks with more transactions remaining after the other transforms are truncated to their first transactions, in block order, and a warning logged, protects downstream systems from pathological blocks like large airdrops")
+var flagSkipExisting = flag.Bool("skip-existing", false, "When set, the -o file is appended to and streaming starts after the block of its last record, if past the <start_block>, making an interrupted run without cursor resumable, the -o file must not use the {range} or {time} placeholders and --format must be 'block' or 'headers'")
+var flagWaitOnEOF = flag.Duration("wait-on-eof", 0, "When greater than 0, a stream ending before the <end_block> of the range was reached, or ending at all for an unbounded range, is requested again from the last cursor after waiting this long instead of exiting, a bounded range that completed still exits")
+var flagMinGas = flag.Uint64("min-gas", 0, "When greater than 0, transactions that used less gas than this are removed from the blocks before they are written, ex: 21001 drops plain transfers")
+var flagErrorFormat = flag.String("error-format", "text", "Format of the fatal error printed to standard error before exiting, 'text' prints the plain message, 'json' prints a '{\"error\": \"...\", \"code\": N}' object, N being the exit code of the process, 1 for a generic failure, 2 for invalid arguments, 3 for an authentication failure and 4 for a connection or stream failure and 5 for a failure writing the output")
+var flagPrintCursorOnExit = flag.Bool("print-cursor-on-exit", false, "When set, the cursor of the last written block is printed alone on standard output once the stream completes or is interrupted, ready to be given to --start-cursor on the next run, the summary staying on standard error")
+var flagStrictAddresses = flag.Bool("strict-addresses", false, "When set, exits with an error instead of logging a warning when the <filter> compares 'from', 'to', 'erc20_from' or 'erc20_to' to a value that is not a 0x prefixed 20-byte hex address")
+var flagRotateInterval = flag.Duration("rotate-interval", 0, "When greater than 0, the output file is closed and a new one opened every such wall-clock interval (ex: 1h), between blocks, the -o path must then contain the {time} placeholder replaced by the UTC time the file was opened at (ex: 20210301T150405Z)")
+var flagRetryBudget = flag.Int("retry-budget", 0, "When greater than 0, each reconnection after a stream error spends one retry from a budget of this many retries, refilled by one every --retry-refill-interval, the process exits once the budget is exhausted, tolerating bursts of errors but not sustained churn")
+var flagRetryRefillInterval = flag.Duration("retry-refill-interval", time.Minute, "Interval at which one retry is given back to the --retry-budget, up to its size")
+var flagFlushEvery = flag.String("flush-every", "", "When set, buffers the output and flushes it every N blocks ('block' flushing after each block) or once the given duration elapsed (ex: 500ms, checked as blocks are written), unset writes each block unbuffered")
 
 func main() {
-	setupFlag()
+	subcommand, args := setupFlag()
+	if *flagSummaryOnly {
+		zlog = zlog.WithOptions(zap.IncreaseLevel(zap.WarnLevel))
+	}
+
+	stopProfiling := startProfiling()
+	defer stopProfiling()
 
-	args := flag.Args()
-	ensure((len(args) == 1 && *flagStartCursor != "") || len(args) > 1, errorUsage("Expecting between 1 and 3 arguments"))
-	ensure(noMoreThanOneTrue(*flagBSC, *flagPolygon, *flagHECO, *flagFantom), errorUsage("Cannot set more than one network flag (ex: --polygon, --bsc)"))
+	if subcommand == "inspect" {
+		ensure(len(args) == 2, errorUsage("The inspect command expects exactly a <filter> and a <block_num> argument"))
+		ensure(*flagStartCursor == "" && *flagResumeFromBlock == "" && *flagStartTime == "", errorUsage("Cannot use --start-cursor, --resume-from-block or --start-time along the inspect command"))
+		*flagPretty = true
+	}
+
+	ensure((len(args) == 1 && (*flagStartCursor != "" || *flagResumeFromBlock != "" || *flagTail > 0 || *flagStartTime != "")) || len(args) > 1, errorUsage("Expecting between 1 and 3 arguments"))
+	ensure(*flagTail == 0 || len(args) == 1, errorUsage("Cannot use <start_block> and <end_block> arguments along --tail"))
+	// The --resume-from-block flag discards --start-cursor, the two can be set together
+	ensure(noMoreThanOneTrue(*flagTail > 0, *flagStartCursor != "" || *flagResumeFromBlock != "", *flagStartTime != ""), errorUsage("Cannot set more than one of --tail, --start-time and --start-cursor/--resume-from-block"))
+	ensure(*flagStartTime == "" || len(args) == 1, errorUsage("Cannot use <start_block> and <end_block> arguments along --start-time"))
+	ensure(*flagEndTime == "" || *flagStartTime != "", errorUsage("The --end-time flag requires --start-time to be set"))
+	ensure(*flagStopBlock == 0 || (*flagStartTime == "" && subcommand != "inspect"), errorUsage("Cannot use --stop-block along --start-time or the inspect command"))
+	ensure(*flagStartCursor == "" || len(args) == 1, errorUsage("Cannot use <start_block> and <end_block> arguments along --start-cursor, use --stop-block to bound the stream"))
+	ensure(*flagResumeFromBlock == "" || len(args) == 1, errorUsage("Cannot use <start_block> and <end_block> arguments along --resume-from-block"))
+	ensure(noMoreThanOneTrue(*flagBSC, *flagPolygon, *flagHECO, *flagFantom, *flagOptimism, *flagAvalanche), errorUsage("Cannot set more than one network flag (ex: --polygon, --bsc)"))
+	ensure(!(*flagS3Bucket != "" && *flagSplitByBlock), errorUsage("Cannot use --split-by-block along --s3-bucket"))
+	ensure(!(*flagWebhookURL != "" && (*flagSplitByBlock || *flagS3Bucket != "")), errorUsage("Cannot use --webhook-url along --split-by-block or --s3-bucket"))
+	ensure((*flagPubsubProject == "") == (*flagPubsubTopic == ""), errorUsage("The --pubsub-project and --pubsub-topic flags must be used together"))
+	ensure(!(*flagPubsubProject != "" && (*flagSplitByBlock || *flagS3Bucket != "" || *flagWebhookURL != "")), errorUsage("Cannot use --pubsub-project along --split-by-block, --s3-bucket or --webhook-url"))
+	ensure(*flagWebhookBatchSize > 0, errorUsage("The --webhook-batch-size value must be greater than 0"))
+	ensure(*flagErrorFormat == "text" || *flagErrorFormat == "json", errorUsage("The --error-format value %q is invalid, valid values are \"text\" and \"json\"", *flagErrorFormat))
+	ensure(indexOf(formats, *flagFormat) != -1, errorUsage("The --format value %q is invalid, valid values are %q", *flagFormat, formats))
+	ensure(!(*flagFormat != "block" && *flagSplitByBlock), errorUsage("Cannot use --format %s along --split-by-block", *flagFormat))
+	ensure(!(*flagReorgSafe && *flagHandleForks), errorUsage("Cannot use --reorg-safe along --handle-forks"))
+	ensure(!(*flagCompactTrace && *flagFormat == "storage-changes"), errorUsage("Cannot use --compact-trace along --format storage-changes"))
+	// Without STEP_UNDO notifications, a reorg resends block numbers at or below the head without notice
+	ensure(!*flagVerifyOrder || *flagHandleForks, errorUsage("The --verify-order flag requires --handle-forks, reorgs being otherwise indistinguishable from out of order blocks"))
+	ensure(!(*flagReorgSafe && *flagMinConfirmations > 0), errorUsage("Cannot use --min-confirmations along --reorg-safe"))
+	// Without STEP_UNDO notifications, forked out blocks would never be dropped from the buffer
+	ensure(*flagMinConfirmations == 0 || *flagHandleForks, errorUsage("The --min-confirmations flag requires --handle-forks to be notified of forked out blocks"))
+	ensure(!*flagAnnotateContracts || *flagFormat == "trx-json" || *flagFormat == "native-transfers", errorUsage("The --annotate-contracts flag can only be used along --format trx-json or --format native-transfers"))
+	ensure(*flagMaxTrxsPerBlock >= 0, errorUsage("The --max-trxs-per-block flag must be greater or equal to 0"))
+	ensure(!*flagSkipExisting || (*flagStartCursor == "" && *flagResumeFromBlock == "" && *flagTail == 0 && *flagStartTime == "" && subcommand != "inspect"), errorUsage("The --skip-existing flag can only be used with an absolute <start_block>, not along --start-cursor, --resume-from-block, --tail, --start-time or the inspect command"))
+	ensure(!*flagSkipExisting || (outputPath(blockRange{}) != "" && outputPath(blockRange{}) != "-" && !strings.Contains(*flagWrite, "{range}") && !strings.Contains(*flagWrite, "{time}") && *flagS3Bucket == "" && *flagWebhookURL == "" && *flagPubsubProject == "" && !*flagSplitByBlock && !*flagPretty), errorUsage("The --skip-existing flag requires a -o file without the {range} and {time} placeholders, written one record per line, cannot be used along standard output, --s3-bucket, --webhook-url, --pubsub-project, --split-by-block or --pretty"))
+	// Only the last record is read, it must tell the last block fully written
+	ensure(!*flagSkipExisting || ((*flagFormat == "block" || *flagFormat == "headers") && !*flagHandleForks && *flagHeartbeat == 0), errorUsage("The --skip-existing flag requires --format block or headers, writing exactly one record per block, and cannot be used along --handle-forks or --heartbeat whose undo and heartbeat records would be taken as the last block written"))
+	ensure(!(*flagFormat == "proto-stream" && (*flagHandleForks || *flagPretty || *flagSequence || *flagHeartbeat > 0 || *flagWebhookURL != "" || *flagPubsubProject != "" || *flagSkipExisting)), errorUsage("Cannot use --format proto-stream along --handle-forks, --pretty, --sequence, --heartbeat, --webhook-url, --pubsub-project or --skip-existing, its messages carry neither fork steps nor any other record"))
+	ensure(*flagRotateInterval >= 0, errorUsage("The --rotate-interval value must be greater or equal to 0"))
+	// The {time} placeholder has a one second resolution, shorter intervals would reuse file names
+	ensure(*flagRotateInterval == 0 || *flagRotateInterval >= time.Second, errorUsage("The --rotate-interval value must be at least 1s"))
+	ensure(*flagRotateInterval == 0 || strings.Contains(*flagWrite, "{time}"), errorUsage("The --rotate-interval flag requires a -o path containing the {time} placeholder"))
+	ensure(!(*flagRotateInterval > 0 && (*flagSplitByBlock || *flagS3Bucket != "" || *flagWebhookURL != "" || *flagPubsubProject != "")), errorUsage("Cannot use --rotate-interval along --split-by-block, --s3-bucket, --webhook-url or --pubsub-project"))
+	ensure(*flagRetryBudget >= 0, errorUsage("The --retry-budget value must be greater or equal to 0"))
+	ensure(*flagRetryBudget == 0 || *flagRetryRefillInterval > 0, errorUsage("The --retry-refill-interval value must be greater than 0"))
+	ensure(!(*flagSequence && *flagSplitByBlock), errorUsage("Cannot use --sequence along --split-by-block"))
+	ensure(!(*flagSequence && (*flagWebhookURL != "" || *flagPubsubProject != "")), errorUsage("Cannot use --sequence along --webhook-url or --pubsub-project, the prefix would make their JSON payloads invalid"))
+	ensure(!(*flagFormat == "headers" && *flagWebhookURL != ""), errorUsage("Cannot use --format headers along --webhook-url, its text lines would make the JSON payload invalid"))
+	ensure(!(*flagHeartbeat > 0 && *flagSplitByBlock), errorUsage("Cannot use --heartbeat along --split-by-block"))
+	delimiter, found := delimiters[*flagDelimiter]
+	ensure(found, errorUsage("The --delimiter value %q is invalid, valid values are 'lf', 'crlf' and 'nul'", *flagDelimiter))
+	endOfLine = delimiter
+
+	ensure(*flagMaxRecvMsgSize > 0, errorUsage("The --max-recv-msg-size value must be greater than 0"))
+	ensure(*flagWriteRate >= 0, errorUsage("The --write-rate value must be greater or equal to 0"))
+	if *flagWriteRate > 0 {
+		writeLimiter = newTokenBucket(*flagWriteRate)
+	}
+
+	ensure(*flagSampleRate > 0 && *flagSampleRate <= 1, errorUsage("The --sample-rate value must be greater than 0.0 and lower or equal to 1.0"))
+
+	var minAmount *big.Int
+	if *flagMinAmount != "" {
+		var valid bool
+		minAmount, valid = new(big.Int).SetString(*flagMinAmount, 10)
+		ensure(valid && minAmount.Sign() > 0, errorUsage("The --min-amount value %q is invalid, it must be an integer greater than 0 in the token base units", *flagMinAmount))
+	}
+
+	filter, err := expandFilterVars(args[0], *flagVars)
+	noErrorWithCode(exitUsage, err, "invalid <filter> value")
+
+	filter, malformed := normalizeFilterAddresses(filter)
+	for _, address := range malformed {
+		zlog.Warn("Filter compares an address field to a value that is not a 20-byte hex address, it will never match", zap.String("value", address))
+	}
+	ensure(!*flagStrictAddresses || len(malformed) == 0, errorUsage("The <filter> compares address fields to malformed addresses %q, each must be a 0x prefixed 20-byte hex address", malformed))
+
+	if *flagMethod != "" {
+		selector, err := methodSelector(*flagMethod)
+		noErrorWithCode(exitUsage, err, "invalid --method value")
+
+		filter = andFilter(filter, fmt.Sprintf("input.startsWith('%s')", selector))
+	}
+
+	topics, err := topicSet(*flagTopics)
+	noErrorWithCode(exitUsage, err, "invalid --topic value")
+
+	var fallbackBlock int64
+	if *flagCursorFallback {
+		ensure(*flagFallbackBlock != "", errorUsage("The --cursor-fallback flag requires --fallback-block to be set"))
+
+		fallback, err := newBlockRange([]string{*flagFallbackBlock})
+		noErrorWithCode(exitUsage, err, "invalid --fallback-block value")
+		fallbackBlock = fallback.start
+	}
 
-	filter := args[0]
 	cursor := *flagStartCursor
 	var brange blockRange
-	if cursor == "" {
-		brange = newBlockRange(args[1:])
+	var startTime, endTime time.Time
+	switch {
+	case subcommand == "inspect":
+		var err error
+		brange, err = newBlockRange(args[1:])
+		noErrorWithCode(exitUsage, err, "invalid <block_num> argument")
+		ensure(brange.start >= 0, errorUsage("The <block_num> value must be an absolute block number"))
+		// A 0 end block requests an unbounded stream, the genesis block cannot be bounded to itself
+		ensure(brange.start > 0, errorUsage("The inspect command cannot inspect block 0, a stop block of 0 meaning no end block"))
+
+		// The end block is inclusive, so this is exactly one block
+		brange.end = uint64(brange.start)
+	case *flagTail > 0:
+		brange = blockRange{start: -int64(*flagTail)}
+	case *flagStartTime != "":
+		// Range is resolved from the time range once connected
+		startTime, endTime = parseTimeRange(*flagStartTime, *flagEndTime)
+	case *flagResumeFromBlock != "":
+		if cursor != "" {
+			zlog.Info("Discarding start cursor, resuming from block instead", zap.String("cursor", cursor), zap.String("resume_from_block", *flagResumeFromBlock))
+			cursor = ""
+		}
+		var err error
+		brange, err = newBlockRange([]string{*flagResumeFromBlock})
+		noErrorWithCode(exitUsage, err, "invalid --resume-from-block value")
+	case cursor == "":
+		var err error
+		brange, err = newBlockRange(args[1:])
+		noErrorWithCode(exitUsage, err, "invalid arguments")
+	}
+
+	if *flagStopBlock != 0 {
+		// Also bounds streams resuming from a cursor which have no <end_block> argument
+		var err error
+		brange, err = withStopBlock(brange, *flagStopBlock)
+		noErrorWithCode(exitUsage, err, "invalid --stop-block value")
+	}
+
+	if *flagSkipExisting {
+		ensure(brange.start >= 0, errorUsage("The --skip-existing flag requires an absolute <start_block>, not one relative to the chain head"))
+		path := outputPath(brange)
+		last, found, err := lastRecordBlockNum(path)
+		noErrorWithCode(exitOutput, err, "unable to read last block number of existing output file %q", path)
+
+		if found && int64(last) >= brange.start {
+			zlog.Info("Skipping blocks already present in output file", zap.String("path", path), zap.Uint64("last_block", last), zap.Int64("requested_start", brange.start))
+			if brange.end != 0 && last >= brange.end {
+				zlog.Info("Output file already covers the whole range, nothing to do", zap.Stringer("range", brange))
+				return
+			}
+
+			brange.start = int64(last) + 1
+		}
+
+		// Existing records are kept, new ones going after them
+		*flagAppend = true
+	}
+
+	endpoints := resolveEndpoints()
+	if *flagPrintConfig {
+		printConfig(endpoints, filter, brange, cursor)
+		return
 	}
 
 	var dialOptions []grpc.DialOption
@@ -66,116 +300,181 @@ func main() {
 		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}))}
 	}
 
+	if *flagProxy != "" {
+		dialOptions = append(dialOptions, setupProxy(*flagProxy)...)
+	}
+
+	if *flagServiceConfig != "" {
+		serviceConfig, err := serviceConfigDialOption(*flagServiceConfig)
+		noErrorWithCode(exitUsage, err, "invalid --service-config value")
+		dialOptions = append(dialOptions, serviceConfig)
+	}
+
 	apiKey := os.Getenv("STREAMINGFAST_API_KEY")
 	ensure(apiKey != "", errorUsage("the environment variable STREAMINGFAST_API_KEY must be set to a valid streamingfast API key value"))
 
-	endpoint := *flagEndpoint
+	dfuse, err := dfuse.NewClient("api.streamingfast.io", apiKey, dfuse.WithAuthURL(authURL))
+	noErrorWithCode(exitStream, err, "unable to create streamingfast client")
+
+	streamClients := make([]pbbstream.BlockStreamV2Client, len(endpoints))
+	for i, endpoint := range endpoints {
+		conn, err := dgrpc.NewExternalClient(endpoint, dialOptions...)
+		noErrorWithCode(exitStream, err, "unable to create external gRPC client for %q", endpoint)
+
+		streamClients[i] = pbbstream.NewBlockStreamV2Client(conn)
+	}
+
+	ctx := cancelOnTerminationSignal()
+	authBreaker := &authCircuitBreaker{limit: *flagAuthFailureLimit}
+
+	if !startTime.IsZero() {
+		tokenInfo, err := getAPITokenInfo(ctx, dfuse, *flagTokenRetry, authBreaker)
+		noErrorWithCode(exitAuth, err, "unable to retrieve StreamingFast API token")
+
+		credentials := oauth.NewOauthAccess(&oauth2.Token{AccessToken: tokenInfo.Token, TokenType: "Bearer"})
+		brange, err = resolveTimeRange(ctx, newBlockFetcher(streamClients[0], streamCallOptions(credentials)...), startTime, endTime)
+		noErrorWithCode(exitStream, err, "unable to resolve block range from time range")
+	}
+
+	stats, cursor := streamBlocks(ctx, streamSetup{
+		endpoints:   endpoints,
+		clients:     streamClients,
+		authBreaker: authBreaker,
+		token: func(ctx context.Context) (string, error) {
+			tokenInfo, err := getAPITokenInfo(ctx, dfuse, *flagTokenRetry, authBreaker)
+			if err != nil {
+				return "", err
+			}
+			return tokenInfo.Token, nil
+		},
+		brange:        brange,
+		cursor:        cursor,
+		filter:        filter,
+		topics:        topics,
+		minAmount:     minAmount,
+		fallbackBlock: fallbackBlock,
+	})
+
+	if *flagJSONStats {
+		printJSONStats(stats)
+	} else {
+		printStats(stats)
+	}
+
+	if *flagPrintCursorOnExit && cursor != "" {
+		fmt.Fprintln(os.Stdout, cursor)
+	}
+}
+
+func resolveEndpoints() []string {
+	if len(*flagEndpoints) > 0 {
+		return *flagEndpoints
+	}
+
+	return []string{resolveEndpoint()}
+}
+
+func resolveEndpoint() string {
 	switch {
 	case *flagBSC:
-		endpoint = "bsc.streamingfast.io:443"
+		return "bsc.streamingfast.io:443"
 	case *flagPolygon:
-		endpoint = "polygon.streamingfast.io:443"
+		return "polygon.streamingfast.io:443"
 	case *flagHECO:
-		endpoint = "heco.streamingfast.io:443"
+		return "heco.streamingfast.io:443"
 	case *flagFantom:
-		endpoint = "fantom.streamingfast.io:443"
+		return "fantom.streamingfast.io:443"
+	case *flagOptimism:
+		return "optimism.streamingfast.io:443"
+	case *flagAvalanche:
+		return "avalanche.streamingfast.io:443"
 	default:
 		if e := os.Getenv("STREAMINGFAST_ENDPOINT"); e != "" {
-			endpoint = e
+			return e
 		}
 	}
 
-	dfuse, err := dfuse.NewClient("api.streamingfast.io", apiKey)
-	noError(err, "unable to create streamingfast client")
+	return *flagEndpoint
+}
 
-	conn, err := dgrpc.NewExternalClient(endpoint, dialOptions...)
-	noError(err, "unable to create external gRPC client")
+func streamCallOptions(callCredentials credentials.PerRPCCredentials) []grpc.CallOption {
+	options := []grpc.CallOption{grpc.PerRPCCredentials(callCredentials), grpc.MaxCallRecvMsgSize(*flagMaxRecvMsgSize)}
+	if *flagGRPCCompression {
+		options = append(options, grpc.UseCompressor(gzip.Name))
+	}
 
-	streamClient := pbbstream.NewBlockStreamV2Client(conn)
+	return options
+}
 
-	stats := newStats()
-	nextStatus := time.Now().Add(statusFrequency)
-	writer, closer := blockWriter(brange)
-	defer closer()
+// requestedDetails returns the level of details requested for blocks, light
+// blocks without any transaction being enough when only headers are written
+func requestedDetails() pbbstream.BlockDetails {
+	if *flagFormat == "headers" {
+		return pbbstream.BlockDetails_BLOCK_DETAILS_LIGHT
+	}
 
-	lastBlockRef := bstream.BlockRefEmpty
+	return pbbstream.BlockDetails_BLOCK_DETAILS_FULL
+}
 
-	zlog.Info("Starting stream", zap.Stringer("range", brange), zap.String("cursor", cursor), zap.String("endpoint", endpoint), zap.Bool("handle_forks", *flagHandleForks))
-stream:
-	for {
-		tokenInfo, err := dfuse.GetAPITokenInfo(context.Background())
-		noError(err, "unable to retrieve StreamingFast API token")
+func requestedForkSteps() []pbbstream.ForkStep {
+	// Irreversible blocks are sent in full by the server, only requesting them
+	// gives a stream that never needs to be reverted.
+	if *flagReorgSafe {
+		return []pbbstream.ForkStep{pbbstream.ForkStep_STEP_IRREVERSIBLE}
+	}
 
-		forkSteps := []pbbstream.ForkStep{pbbstream.ForkStep_STEP_NEW}
-		if *flagHandleForks {
-			forkSteps = append(forkSteps, pbbstream.ForkStep_STEP_IRREVERSIBLE, pbbstream.ForkStep_STEP_UNDO)
-		}
+	forkSteps := []pbbstream.ForkStep{pbbstream.ForkStep_STEP_NEW}
+	if *flagHandleForks {
+		forkSteps = append(forkSteps, pbbstream.ForkStep_STEP_IRREVERSIBLE, pbbstream.ForkStep_STEP_UNDO)
+	}
 
-		credentials := oauth.NewOauthAccess(&oauth2.Token{AccessToken: tokenInfo.Token, TokenType: "Bearer"})
-		stream, err := streamClient.Blocks(context.Background(), &pbbstream.BlocksRequestV2{
-			StartBlockNum:     brange.start,
-			StartCursor:       cursor,
-			StopBlockNum:      brange.end,
-			ForkSteps:         forkSteps,
-			IncludeFilterExpr: filter,
-			Details:           pbbstream.BlockDetails_BLOCK_DETAILS_FULL,
-		}, grpc.PerRPCCredentials(credentials))
-		noError(err, "unable to start blocks stream")
-
-		for {
-			zlog.Debug("Waiting for message to reach us")
-			response, err := stream.Recv()
-			if err != nil {
-				if err == io.EOF {
-					break stream
-				}
+	return forkSteps
+}
 
-				zlog.Error("Stream encountered a remote error, going to retry", zap.String("cursor", cursor), zap.Stringer("last_block", lastBlockRef), zap.Duration("retry_delay", retryDelay), zap.Error(err))
-				break
-			}
+func parseTimeRange(rawStart, rawEnd string) (start time.Time, end time.Time) {
+	start, err := time.Parse(time.RFC3339, rawStart)
+	ensure(err == nil, "the --start-time value %q is not a valid RFC3339 timestamp (ex: 2021-01-27T21:58:38Z)", rawStart)
 
-			zlog.Debug("Decoding received message's block")
-			block := &pbcodec.Block{}
-			err = ptypes.UnmarshalAny(response.Block, block)
-			noError(err, "should have been able to unmarshal received block payload")
+	if rawEnd != "" {
+		end, err = time.Parse(time.RFC3339, rawEnd)
+		ensure(err == nil, "the --end-time value %q is not a valid RFC3339 timestamp (ex: 2021-01-27T21:58:38Z)", rawEnd)
+		ensure(end.After(start), "the --end-time value %q must be after --start-time value %q", rawEnd, rawStart)
+	}
 
-			cursor = response.Cursor
-			lastBlockRef = block.AsRef()
+	return
+}
 
-			if traceEnabled {
-				zlog.Debug("Block received", zap.Stringer("block", lastBlockRef), zap.Stringer("previous", bstream.NewBlockRefFromID(block.PreviousID())), zap.String("cursor", cursor))
-			}
+type stringSlice []string
 
-			now := time.Now()
-			if now.After(nextStatus) {
-				zlog.Info("Stream blocks progress", zap.Object("stats", stats))
-				nextStatus = now.Add(statusFrequency)
-			}
+func stringSliceFlag(name string, usage string) *stringSlice {
+	value := &stringSlice{}
+	flag.Var(value, name, usage)
 
-			if writer != nil {
-				writeBlock(writer, response, block)
-			}
+	return value
+}
 
-			stats.recordBlock(int64(response.XXX_Size()))
-		}
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
 
-		time.Sleep(5 * time.Second)
-		stats.restartCount.IncBy(1)
-	}
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
-	elapsed := stats.duration()
+// blockTime returns the block's timestamp formatted as RFC3339, empty if the
+// block has no valid timestamp.
+func blockTime(block *pbcodec.Block) string {
+	if block.Header == nil {
+		return ""
+	}
 
-	println("")
-	println("Completed streaming")
-	printf("Duration: %s\n", elapsed)
-	printf("Time to first block: %s\n", stats.timeToFirstBlock)
-	if stats.restartCount.total > 0 {
-		printf("Restart count: %s\n", stats.restartCount.Overall(elapsed))
+	timestamp, err := ptypes.Timestamp(block.Header.Timestamp)
+	if err != nil {
+		return ""
 	}
 
-	println("")
-	printf("Block received: %s\n", stats.blockReceived.Overall(elapsed))
-	printf("Bytes received: %s\n", stats.bytesReceived.Overall(elapsed))
+	return timestamp.Format(time.RFC3339)
 }
 
 func noMoreThanOneTrue(bools ...bool) bool {
@@ -191,88 +490,46 @@ func noMoreThanOneTrue(bools ...bool) bool {
 	return true
 }
 
-var endOfLine = []byte("\n")
-
-func writeBlock(writer io.Writer, response *pbbstream.BlockResponseV2, block *pbcodec.Block) {
-	line, err := jsonpb.MarshalToString(response)
-	noError(err, "unable to marshal block %s to JSON", block.AsRef())
-
-	_, err = writer.Write([]byte(line))
-	noError(err, "unable to write block %s line to JSON", block.AsRef())
-
-	_, err = writer.Write(endOfLine)
-	noError(err, "unable to write block %s line ending", block.AsRef())
-}
-
-func blockWriter(bRange blockRange) (io.Writer, func()) {
-	if flagWrite == nil || strings.TrimSpace(*flagWrite) == "" {
-		return nil, func() {}
+// newBlockRange parses the positional <start_block> [<end_block>] arguments,
+// ex: "11700000 11700001" or "-1000".
+func newBlockRange(args []string) (out blockRange, err error) {
+	if len(args) == 0 {
+		return out, fmt.Errorf("the <start_block> value is required")
 	}
 
-	out := strings.Replace(strings.TrimSpace(*flagWrite), "{range}", strings.ReplaceAll(bRange.String(), " ", ""), 1)
-	if out == "-" {
-		return os.Stdout, func() {}
+	if !isInt(args[0]) {
+		return out, fmt.Errorf("the <start_block> value %q is not a valid int64 value", args[0])
 	}
-
-	dir := filepath.Dir(out)
-	noError(os.MkdirAll(dir, os.ModePerm), "unable to create directories %q", dir)
-
-	file, err := os.Create(out)
-	noError(err, "unable to create file %q", out)
-
-	return file, func() { file.Close() }
-}
-
-type stats struct {
-	startTime        time.Time
-	timeToFirstBlock time.Duration
-	blockReceived    *counter
-	bytesReceived    *counter
-	restartCount     *counter
-}
-
-func newStats() *stats {
-	return &stats{
-		startTime:     time.Now(),
-		blockReceived: &counter{0, ratecounter.NewRateCounter(1 * time.Second), "block", "s"},
-		bytesReceived: &counter{0, ratecounter.NewRateCounter(1 * time.Second), "byte", "s"},
-		restartCount:  &counter{0, ratecounter.NewRateCounter(1 * time.Minute), "restart", "m"},
+	out.start, _ = strconv.ParseInt(args[0], 10, 64)
+	if len(args) == 1 {
+		return out, nil
 	}
-}
-
-func (s *stats) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
-	encoder.AddString("block", s.blockReceived.String())
-	encoder.AddString("bytes", s.bytesReceived.String())
-	return nil
-}
-
-func (s *stats) duration() time.Duration {
-	return time.Now().Sub(s.startTime)
-}
 
-func (s *stats) recordBlock(payloadSize int64) {
-
-	if s.timeToFirstBlock == 0 {
-		s.timeToFirstBlock = time.Now().Sub(s.startTime)
+	if !isUint(args[1]) {
+		return out, fmt.Errorf("the <end_block> value %q is not a valid uint64 value", args[1])
 	}
+	out.end, _ = strconv.ParseUint(args[1], 10, 64)
 
-	s.blockReceived.IncBy(1)
-	s.bytesReceived.IncBy(payloadSize)
+	if out.start >= 0 && uint64(out.start) >= out.end {
+		return out, fmt.Errorf("the <start_block> value %d must be lower than the <end_block> value %d", out.start, out.end)
+	}
+	return out, nil
 }
 
-// arg"11700000 - 11700001"
-// -1000
+// withStopBlock returns the range ending at stopBlock, inclusively, the range
+// must not already have an end and must start before stopBlock. A range
+// relative to the chain head can't be checked and is always accepted.
+func withStopBlock(in blockRange, stopBlock uint64) (blockRange, error) {
+	if in.end != 0 {
+		return in, fmt.Errorf("cannot be used along the <end_block> argument")
+	}
 
-func newBlockRange(args []string) (out blockRange) {
-	ensure(isInt(args[0]), "the <range> start value %q is not a valid uint64 value", args[0])
-	out.start, _ = strconv.ParseInt(args[0], 10, 64)
-	if len(args) == 1 {
-		return
+	if in.start >= 0 && uint64(in.start) >= stopBlock {
+		return in, fmt.Errorf("the stop block %d must be greater than the start block %d", stopBlock, in.start)
 	}
-	ensure(isUint(args[1]), "the <range> end value %q is not a valid uint64 value", args[1])
-	out.end, _ = strconv.ParseUint(args[1], 10, 64)
-	ensure(out.start < int64(out.end), "the <range> start value %q value comes after end value %q", args[0], args[1])
-	return
+
+	in.end = stopBlock
+	return in, nil
 }
 
 func isUint(in string) bool {
@@ -286,16 +543,28 @@ func isInt(in string) bool {
 }
 
 func errorUsage(message string, args ...interface{}) string {
+	if *flagErrorFormat == "json" {
+		// The usage would drown the error, the JSON object being meant for scripts
+		return fmt.Sprintf(message, args...)
+	}
+
 	return fmt.Sprintf(message+"\n\n"+usage(), args...)
 }
 
 func usage() string {
-	return `usage: sf [flags] <filter> [<start_block>] [<end_block>]
+	return `usage: sf [stream] [flags] <filter> [<start_block>] [<end_block>]
+       sf inspect [flags] <filter> <block_num>
 
 Connects to StreamingFast endpoint using the STREAMINGFAST_API_KEY from
 environment variables and stream back blocks filterted using the <filter>
 argument within the <start_block> and <end_block> if they are specified.
 
+Commands:
+  stream          Streams blocks, the default when no command is given.
+
+  inspect         Writes the single block <block_num> as indented JSON, the
+                  same as streaming it using --pretty.
+
 Parameters:
   <filter>        A valid CEL filter expression for the Ethereum network, only
                   transactions matching the filter will be returned to you.
@@ -317,6 +586,33 @@ Examples:
   # Watch all calls to the UniswapV2 Router, include the last 100 blocks, and stream forever
   $ sf "to in ['0x7a250d5630b4cf539739df2c5dacb4c659f2488d']" -100
 
+  # Same as above, using the --tail flag
+  $ sf --tail 100 "to in ['0x7a250d5630b4cf539739df2c5dacb4c659f2488d']"
+
+  # Watch all ERC20 transfer(address,uint256) calls made directly to the USDT contract
+  $ sf --method "transfer(address,uint256)" "to == '0xdac17f958d2ee523a2206206994597c13d831ec7'" -100
+
+  # Reuse a filter template, each $NAME placeholder being replaced by its --var value
+  $ sf --var ROUTER=0x7a250d5630b4cf539739df2c5dacb4c659f2488d "to == '$ROUTER'" -100
+
+  # Write each transaction sent to the USDT contract as its own JSON line instead of whole blocks
+  $ sf --format trx-json "to == '0xdac17f958d2ee523a2206206994597c13d831ec7'" -100
+
+  # Watch the storage slots changed by calls of transactions sent to the USDT contract
+  $ sf --format storage-changes "to == '0xdac17f958d2ee523a2206206994597c13d831ec7'" -100
+
+  # Inspect the structure of a single block as indented JSON
+  $ sf inspect "true" 11700000
+
+  # Watch the chain head progress, writing only the number, ID and timestamp of each block
+  $ sf --format headers "true" -1
+
+  # Estimate the volume of a range, only printing the final summary
+  $ sf --summary-only "true" 11700000 11701000
+
+  # Archive the transactions sent to the USDT contract while following the chain head, one file per hour
+  $ sf --tail 1 --rotate-interval 1h -o "usdt-{time}.jsonl" "to == '0xdac17f958d2ee523a2206206994597c13d831ec7'"
+
   # Continue where you left off, start from the last known cursor, get all fork notifications (UNDO, IRREVERSIBLE), stream forever
   $ sf --handle-forks --start-cursor "10928019832019283019283" "to in ['0x7a250d5630b4cf539739df2c5dacb4c659f2488d']"
 
@@ -331,14 +627,71 @@ Examples:
 
   # Look at recent blocks and stream forever on Fantom Opera Mainnet
   $ sf --fantom "true" -5
+
+  # Look at ALL blocks in a given range on Optimism Mainnet
+  $ sf --optimism "true" 100000 100002
+
+  # Look at ALL blocks in a given range on Avalanche C-Chain
+  $ sf --avalanche "true" 100000 100002
 `
 }
 
-func setupFlag() {
+// subcommands are the modes sf runs in, selected by the first argument, the
+// `stream` mode being used when the first argument is not one of them.
+var subcommands = []string{"stream", "inspect"}
+
+func setupFlag() (subcommand string, args []string) {
 	flag.CommandLine.Usage = func() {
 		fmt.Print(usage())
 	}
-	flag.Parse()
+
+	subcommand, arguments := "stream", os.Args[1:]
+	if len(arguments) > 0 && indexOf(subcommands, arguments[0]) != -1 {
+		subcommand, arguments = arguments[0], arguments[1:]
+	}
+	// Errors are handled by the flag set itself which exits on them
+	flag.CommandLine.Parse(arguments)
+
+	var configured []string
+	if *flagConfig != "" {
+		configured = loadConfigFile(*flagConfig)
+	}
+
+	args = flag.Args()
+	if *flagFilterFile != "" {
+		ensure(len(configured) == 0 || configured[0] == "", errorUsage("Cannot use --filter-file along a config file setting \"filter\""))
+
+		filter, err := loadFilterFile(*flagFilterFile)
+		noErrorWithCode(exitUsage, err, "invalid --filter-file value")
+
+		// The loaded filter takes the place of the <filter> argument
+		args = append([]string{filter}, args...)
+	}
+
+	if *flagConfig != "" {
+		var err error
+		args, err = mergeConfigArgs(args, configured)
+		noErrorWithCode(exitUsage, err, "invalid config file %q", *flagConfig)
+	}
+	return subcommand, args
+}
+
+// cancelOnTerminationSignal returns a context cancelled on the first SIGINT or
+// SIGTERM received so the stream can be stopped gracefully, a second signal
+// terminates the process right away.
+func cancelOnTerminationSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		zlog.Info("Received termination signal, stopping stream", zap.Stringer("signal", sig))
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		cancel()
+	}()
+
+	return ctx
 }
 
 func flagUsage() string {
@@ -352,21 +705,51 @@ func flagUsage() string {
 	return buf.String()
 }
 
+// Exit codes of the process, a wrapping script can tell apart a bad invocation
+// from an authentication problem or a failing stream
+const (
+	exitFailure = 1
+	exitUsage   = 2
+	exitAuth    = 3
+	exitStream  = 4
+	exitOutput  = 5
+)
+
 func ensure(condition bool, message string, args ...interface{}) {
 	if !condition {
-		noError(fmt.Errorf(message, args...), "invalid arguments")
+		noErrorWithCode(exitUsage, fmt.Errorf(message, args...), "invalid arguments")
 	}
 }
 
 func noError(err error, message string, args ...interface{}) {
+	noErrorWithCode(exitFailure, err, message, args...)
+}
+
+func noErrorWithCode(code int, err error, message string, args ...interface{}) {
 	if err != nil {
-		quit(message+": "+err.Error(), args...)
+		quitWithCode(code, message+": "+err.Error(), args...)
 	}
 }
 
 func quit(message string, args ...interface{}) {
-	printf(message+"\n", args...)
-	os.Exit(1)
+	quitWithCode(exitFailure, message, args...)
+}
+
+// quitWithCode prints the message to standard error, as a JSON object
+// `{"error": "...", "code": N}` when `--error-format json` is set, and exits
+// the process with code.
+func quitWithCode(code int, message string, args ...interface{}) {
+	if *flagErrorFormat == "json" {
+		line, _ := json.Marshal(struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}{fmt.Sprintf(message, args...), code})
+		println(string(line))
+	} else {
+		printf(message+"\n", args...)
+	}
+
+	os.Exit(code)
 }
 
 func printf(format string, args ...interface{}) {
@@ -385,40 +768,3 @@ type blockRange struct {
 func (b blockRange) String() string {
 	return fmt.Sprintf("%d - %d", b.start, b.end)
 }
-
-type counter struct {
-	total    uint64
-	counter  *ratecounter.RateCounter
-	unit     string
-	timeUnit string
-}
-
-func (c *counter) IncBy(value int64) {
-	if value <= 0 {
-		return
-	}
-
-	c.counter.Incr(value)
-	c.total += uint64(value)
-}
-
-func (c *counter) Total() uint64 {
-	return c.total
-}
-
-func (c *counter) Rate() int64 {
-	return c.counter.Rate()
-}
-
-func (c *counter) String() string {
-	return fmt.Sprintf("%d %s/%s (%d total)", c.counter.Rate(), c.unit, c.timeUnit, c.total)
-}
-
-func (c *counter) Overall(elapsed time.Duration) string {
-	rate := float64(c.total)
-	if elapsed.Minutes() > 1 {
-		rate = rate / elapsed.Minutes()
-	}
-
-	return fmt.Sprintf("%d %s/%s (%d %s total)", uint64(rate), c.unit, "min", c.total, c.unit)
-}
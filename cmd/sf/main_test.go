@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewBlockRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		expected      blockRange
+		expectedError string
+	}{
+		{"open ended", []string{"1000"}, blockRange{start: 1000}, ""},
+		{"bounded", []string{"1000", "2000"}, blockRange{start: 1000, end: 2000}, ""},
+		{"from genesis", []string{"0", "10"}, blockRange{start: 0, end: 10}, ""},
+		{"relative open ended", []string{"-100"}, blockRange{start: -100}, ""},
+		{"relative bounded", []string{"-100", "2000"}, blockRange{start: -100, end: 2000}, ""},
+
+		{"missing start", nil, blockRange{}, `the <start_block> value is required`},
+		{"start after end", []string{"2000", "1000"}, blockRange{}, `the <start_block> value 2000 must be lower than the <end_block> value 1000`},
+		{"start equal end", []string{"1000", "1000"}, blockRange{}, `the <start_block> value 1000 must be lower than the <end_block> value 1000`},
+		{"malformed start", []string{"abc"}, blockRange{}, `the <start_block> value "abc" is not a valid int64 value`},
+		{"decimal start", []string{"10.5"}, blockRange{}, `the <start_block> value "10.5" is not a valid int64 value`},
+		{"malformed end", []string{"1000", "x"}, blockRange{}, `the <end_block> value "x" is not a valid uint64 value`},
+		{"negative end", []string{"1000", "-1"}, blockRange{}, `the <end_block> value "-1" is not a valid uint64 value`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := newBlockRange(test.args)
+			if test.expectedError != "" {
+				if err == nil || err.Error() != test.expectedError {
+					t.Fatalf("expected error %q, got %v", test.expectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected range %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWithStopBlock(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            blockRange
+		stopBlock     uint64
+		expected      blockRange
+		expectedError string
+	}{
+		{"cursor resumed", blockRange{}, 2000, blockRange{start: 0, end: 2000}, ""},
+		{"open ended", blockRange{start: 1000}, 2000, blockRange{start: 1000, end: 2000}, ""},
+		{"relative start", blockRange{start: -100}, 2000, blockRange{start: -100, end: 2000}, ""},
+		{"just after start", blockRange{start: 1000}, 1001, blockRange{start: 1000, end: 1001}, ""},
+
+		{"along end block", blockRange{start: 1000, end: 1500}, 2000, blockRange{}, `cannot be used along the <end_block> argument`},
+		{"equal to start", blockRange{start: 1000}, 1000, blockRange{}, `the stop block 1000 must be greater than the start block 1000`},
+		{"before start", blockRange{start: 1000}, 10, blockRange{}, `the stop block 10 must be greater than the start block 1000`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := withStopBlock(test.in, test.stopBlock)
+			if test.expectedError != "" {
+				if err == nil || err.Error() != test.expectedError {
+					t.Fatalf("expected error %q, got %v", test.expectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected range %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+// orderVerifier checks that blocks are delivered in order. New blocks must
+// have a number strictly greater than the current head, an undone block must
+// be the current head, moving the head back to its parent, and irreversible
+// blocks, following their own sequence, must have strictly increasing numbers.
+type orderVerifier struct {
+	head         uint64
+	hasHead      bool
+	irreversible uint64
+}
+
+func (v *orderVerifier) check(step pbbstream.ForkStep, block *pbcodec.Block) error {
+	switch step {
+	case pbbstream.ForkStep_STEP_NEW:
+		if v.hasHead && block.Number <= v.head {
+			return fmt.Errorf("new block %s received while head is already at or past it at #%d", block.AsRef(), v.head)
+		}
+		v.head, v.hasHead = block.Number, true
+
+	case pbbstream.ForkStep_STEP_UNDO:
+		if v.hasHead && block.Number != v.head {
+			return fmt.Errorf("undone block %s is not the current head #%d", block.AsRef(), v.head)
+		}
+		v.head, v.hasHead = block.Number-1, true
+
+	case pbbstream.ForkStep_STEP_IRREVERSIBLE:
+		if v.irreversible != 0 && block.Number <= v.irreversible {
+			return fmt.Errorf("irreversible block %s received after irreversible block #%d", block.AsRef(), v.irreversible)
+		}
+		v.irreversible = block.Number
+	}
+
+	return nil
+}
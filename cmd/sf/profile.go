@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts the CPU profile when --cpuprofile is set and returns
+// the function stopping it, which also writes the heap profile when
+// --memprofile is set. Profiles are not written when the process exits early
+// on an error.
+func startProfiling() func() {
+	var cpuFile *os.File
+	if *flagCPUProfile != "" {
+		var err error
+		cpuFile, err = os.Create(*flagCPUProfile)
+		noError(err, "unable to create CPU profile file %q", *flagCPUProfile)
+		noError(pprof.StartCPUProfile(cpuFile), "unable to start CPU profile")
+	}
+
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			noError(cpuFile.Close(), "unable to close CPU profile file %q", *flagCPUProfile)
+		}
+
+		if *flagMemProfile != "" {
+			memFile, err := os.Create(*flagMemProfile)
+			noError(err, "unable to create memory profile file %q", *flagMemProfile)
+			defer memFile.Close()
+
+			// Up-to-date statistics about allocations only come after a garbage collection
+			runtime.GC()
+			noError(pprof.WriteHeapProfile(memFile), "unable to write memory profile")
+		}
+	}
+}
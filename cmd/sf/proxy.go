@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+)
+
+// setupProxy configures both the authentication HTTP calls and the gRPC
+// connection to tunnel through the proxy at rawURL, either an HTTP proxy
+// (`http://[user:password@]host:port`, using CONNECT) or a SOCKS5 proxy
+// (`socks5://[user:password@]host:port`). It returns the gRPC dial options to
+// use.
+//
+// When no proxy is explicitly configured, both the authentication HTTP calls
+// and the gRPC connection already honor the standard `HTTPS_PROXY` environment
+// variable (HTTP CONNECT proxies only for gRPC).
+func setupProxy(rawURL string) []grpc.DialOption {
+	proxyURL, err := url.Parse(rawURL)
+	noErrorWithCode(exitUsage, err, "invalid proxy URL %q", rawURL)
+	ensure(proxyURL.Host != "", "invalid proxy URL %q, expected a 'scheme://host:port' value", rawURL)
+
+	dialer, err := proxyDialer(proxyURL)
+	noErrorWithCode(exitUsage, err, "unable to create proxy dialer for %q", rawURL)
+
+	// The authentication client uses Go's default HTTP transport
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	zlog.Info("Connecting through proxy", zap.String("proxy", proxyURL.Scheme+"://"+proxyURL.Host))
+	return []grpc.DialOption{grpc.WithNoProxy(), grpc.WithContextDialer(dialer)}
+}
+
+func proxyDialer(proxyURL *url.URL) (func(ctx context.Context, addr string) (net.Conn, error), error) {
+	switch proxyURL.Scheme {
+	case "http":
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialHTTPConnect(ctx, proxyURL, addr)
+		}, nil
+
+	case "socks5":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported proxy scheme %q, valid schemes are 'http' and 'socks5'", proxyURL.Scheme)
+}
+
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+
+	request := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: addr}, Host: addr, Header: http.Header{}}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write CONNECT request: %w", err)
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read CONNECT response: %w", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %q: %s", addr, response.Status)
+	}
+
+	return conn, nil
+}
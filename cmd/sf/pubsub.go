@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2/google"
+)
+
+// pubsubBatchSize is the number of messages published at once, well under the
+// 1000 messages limit of a Pub/Sub publish request
+const pubsubBatchSize = 100
+
+// pubsubMaxBatchBytes bounds the encoded size of the messages published at
+// once, under the 10MB limit of a Pub/Sub publish request
+const pubsubMaxBatchBytes = 9 * 1000 * 1000
+
+// pubsubAttempts is the number of times a batch is published before being dropped
+const pubsubAttempts = 3
+
+// pubsubWriter accumulates the records written to it and publishes them, by
+// batches, to a Google Cloud Pub/Sub topic through its REST API, each record
+// being one message with a `block_num` attribute. A batch still failing after
+// all attempts is logged and dropped so the stream keeps going.
+type pubsubWriter struct {
+	url    string
+	client *http.Client
+
+	record     bytes.Buffer
+	messages   []pubsubMessage
+	batchBytes int
+}
+
+// pubsubMessage is a Pub/Sub message as sent to the publish endpoint, data
+// being encoded in base64 by encoding/json as the API expects
+type pubsubMessage struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func (w *pubsubWriter) Write(p []byte) (int, error) {
+	return w.record.Write(p)
+}
+
+// encodedSize is the size of the message once encoded in a publish request
+func (m pubsubMessage) encodedSize() int {
+	size := base64.StdEncoding.EncodedLen(len(m.Data)) + len(`{"data":"","attributes":{}},`)
+	for key, value := range m.Attributes {
+		size += len(key) + len(value) + len(`"":"",`)
+	}
+	return size
+}
+
+// recordWritten completes the record being written for block, the batch being
+// published once it holds enough messages or bytes. A record too large to be
+// published on its own is logged and dropped.
+func (w *pubsubWriter) recordWritten(block *pbcodec.Block) {
+	message := pubsubMessage{
+		Data:       append([]byte(nil), bytes.TrimSuffix(w.record.Bytes(), endOfLine)...),
+		Attributes: map[string]string{"block_num": strconv.FormatUint(block.Number, 10)},
+	}
+	w.record.Reset()
+
+	size := message.encodedSize()
+	if size > pubsubMaxBatchBytes {
+		zlog.Error("Pub/Sub message too large, dropping record", zap.Uint64("block_num", block.Number), zap.Int("encoded_size", size), zap.Int("max_size", pubsubMaxBatchBytes))
+		return
+	}
+
+	if w.batchBytes+size > pubsubMaxBatchBytes {
+		w.flush()
+	}
+
+	w.messages = append(w.messages, message)
+	w.batchBytes += size
+	if len(w.messages) >= pubsubBatchSize {
+		w.flush()
+	}
+}
+
+func (w *pubsubWriter) flush() {
+	if len(w.messages) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Messages []pubsubMessage `json:"messages"`
+	}{w.messages})
+	noError(err, "unable to marshal Pub/Sub messages to JSON")
+
+	err = sendWithRetries("Pub/Sub publish", w.url, pubsubAttempts, func() (bool, error) { return w.publish(body) })
+	if err != nil {
+		zlog.Error("Pub/Sub publish failed, dropping batch", zap.String("url", w.url), zap.Int("record_count", len(w.messages)), zap.Error(err))
+	}
+
+	w.messages = w.messages[:0]
+	w.batchBytes = 0
+}
+
+// publish sends the batch once, telling when failing if the publish is worth
+// retrying, which is the case of network errors, 429 and 5xx responses.
+func (w *pubsubWriter) publish(body []byte) (retryable bool, err error) {
+	response, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 300 {
+		return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500, fmt.Errorf("Pub/Sub responded with status %s", response.Status)
+	}
+	return false, nil
+}
+
+func pubsubBlockWriter() (io.Writer, func()) {
+	zlog.Info("Publishing records to Pub/Sub", zap.String("project", *flagPubsubProject), zap.String("topic", *flagPubsubTopic))
+
+	// Application default credentials, GOOGLE_APPLICATION_CREDENTIALS, gcloud or the metadata server
+	client, err := google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/pubsub")
+	noErrorWithCode(exitAuth, err, "unable to find Google Cloud application default credentials")
+	client.Timeout = 30 * time.Second
+
+	pubsub := &pubsubWriter{
+		url:    fmt.Sprintf("https://pubsub.googleapis.com/v1/projects/%s/topics/%s:publish", *flagPubsubProject, *flagPubsubTopic),
+		client: client,
+	}
+	return pubsub, pubsub.flush
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+func TestPubsubWriterBatchesBySize(t *testing.T) {
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []pubsubMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid publish request: %s", err)
+		}
+
+		var blockNums []string
+		for _, message := range request.Messages {
+			blockNums = append(blockNums, message.Attributes["block_num"])
+		}
+		batches = append(batches, blockNums)
+	}))
+	defer server.Close()
+
+	writer := &pubsubWriter{url: server.URL, client: server.Client()}
+	write := func(num uint64, size int) {
+		writer.Write(bytes.Repeat([]byte("a"), size))
+		writer.Write(endOfLine)
+		writer.recordWritten(&pbcodec.Block{Number: num})
+	}
+
+	// Each record is 4MB once encoded in base64, two of them fitting in a batch
+	for num := uint64(1); num <= 3; num++ {
+		write(num, 3*1000*1000)
+	}
+	// Too large to be published on its own, dropped
+	write(4, 7*1000*1000)
+	write(5, 3*1000*1000)
+	writer.flush()
+
+	expected := [][]string{{"1", "2"}, {"3", "5"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("expected batches %v, got %v", expected, batches)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+)
+
+// tokenBucket limits the rate at which records are written, allowing bursts
+// of up to one second worth of records after an idle period.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perSecond float64) *tokenBucket {
+	burst := perSecond
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: perSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until a token is available and consumes it
+func (b *tokenBucket) wait() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		time.Sleep(time.Duration((1 - b.tokens) / b.rate * float64(time.Second)))
+		b.tokens = 1
+		b.last = time.Now()
+	}
+
+	b.tokens--
+}
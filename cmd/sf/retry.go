@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retryBudget bounds the number of stream reconnections, each one spending a
+// retry from a budget of `size` retries refilled by one every `refill`. Bursts
+// of transient errors are tolerated while sustained churn exhausts the budget.
+type retryBudget struct {
+	size      int
+	refill    time.Duration
+	remaining int
+	last      time.Time
+}
+
+func newRetryBudget(size int, refill time.Duration) *retryBudget {
+	return &retryBudget{size: size, refill: refill, remaining: size, last: time.Now()}
+}
+
+// spend refills the budget by the retries earned since the last call and
+// spends one, returning false when none is left.
+func (b *retryBudget) spend() bool {
+	if earned := int(time.Since(b.last) / b.refill); earned > 0 {
+		b.remaining += earned
+		if b.remaining > b.size {
+			b.remaining = b.size
+		}
+		b.last = b.last.Add(time.Duration(earned) * b.refill)
+	}
+
+	if b.remaining == 0 {
+		return false
+	}
+
+	if b.remaining == b.size {
+		// A full budget earns nothing, the refill period starts with the first spent retry
+		b.last = time.Now()
+	}
+	b.remaining--
+	return true
+}
+
+// sendWithRetries calls send until it succeeds, fails with an error not worth
+// retrying or attempts are exhausted, waiting one more second after each failed
+// attempt, and returns the error of the last attempt. The description (ex:
+// "Webhook delivery") starts the message logged on each retry.
+func sendWithRetries(description string, url string, attempts int, send func() (retryable bool, err error)) (err error) {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var retryable bool
+		if retryable, err = send(); err == nil || !retryable {
+			return err
+		}
+
+		if attempt < attempts {
+			zlog.Warn(description+" failed, retrying", zap.String("url", url), zap.Int("attempt", attempt), zap.Error(err))
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	return err
+}
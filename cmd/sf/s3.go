@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+// s3Writer streams everything written to it into an S3 object through a
+// multipart upload, the upload being completed on Close.
+type s3Writer struct {
+	*io.PipeWriter
+	uploadDone chan error
+}
+
+// newS3Writer starts the upload of the object at key in bucket, credentials
+// and region are resolved from the standard AWS environment variables and
+// shared configuration files.
+func newS3Writer(bucket, key, endpoint string) *s3Writer {
+	config := aws.NewConfig()
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{Config: *config, SharedConfigState: session.SharedConfigEnable})
+	noError(err, "unable to create AWS session")
+
+	reader, writer := io.Pipe()
+	w := &s3Writer{PipeWriter: writer, uploadDone: make(chan error, 1)}
+
+	go func() {
+		_, err := s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{Bucket: aws.String(bucket), Key: aws.String(key), Body: reader})
+
+		// Unblocks any pending write if the upload failed midway
+		reader.CloseWithError(err)
+		w.uploadDone <- err
+	}()
+
+	return w
+}
+
+func (w *s3Writer) Close() error {
+	w.PipeWriter.Close()
+	return <-w.uploadDone
+}
+
+func s3BlockWriter(bRange blockRange) (io.Writer, func()) {
+	name := "blocks-{range}.jsonl"
+	if out := strings.TrimSpace(*flagWrite); out != "" && out != "-" {
+		name = filepath.Base(out)
+	}
+
+	key := path.Join(*flagS3Prefix, withRange(name, bRange))
+	zlog.Info("Writing blocks to S3", zap.String("bucket", *flagS3Bucket), zap.String("key", key))
+
+	upload := newS3Writer(*flagS3Bucket, key, *flagS3Endpoint)
+	return withBuffering(upload, false, func() {
+		noErrorWithCode(exitOutput, upload.Close(), "unable to complete upload of S3 object %q", key)
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// defaultRetryServiceConfig retries the establishment of the blocks stream a
+// few times with backoff when the server is momentarily unavailable, before
+// the stream ever gets to the application reconnection loop.
+const defaultRetryServiceConfig = `{
+  "methodConfig": [{
+    "name": [{"service": "dfuse.bstream.v1.BlockStreamV2"}],
+    "retryPolicy": {
+      "maxAttempts": 4,
+      "initialBackoff": "0.5s",
+      "maxBackoff": "5s",
+      "backoffMultiplier": 2,
+      "retryableStatusCodes": ["UNAVAILABLE"]
+    }
+  }]
+}`
+
+// serviceConfigDialOption returns the dial option applying the gRPC service
+// config, either the built-in retry policy when config is `retry` or the
+// given JSON document.
+func serviceConfigDialOption(config string) (grpc.DialOption, error) {
+	if config == "retry" {
+		config = defaultRetryServiceConfig
+	}
+
+	if !json.Valid([]byte(config)) {
+		return nil, fmt.Errorf("service config is neither 'retry' nor a valid JSON document")
+	}
+
+	// The gRPC version in use only honors retry policies when explicitly enabled
+	if strings.Contains(config, "retryPolicy") && !strings.EqualFold(os.Getenv("GRPC_GO_RETRY"), "on") {
+		zlog.Warn("The service config retry policy is ignored unless the GRPC_GO_RETRY=on environment variable is set")
+	}
+
+	return grpc.WithDefaultServiceConfig(config), nil
+}
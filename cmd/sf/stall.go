@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+	"go.uber.org/zap"
+)
+
+// stallWatchdog detects streams that are still connected but not receiving
+// any block anymore. It counts blocks over a window as long as the stall
+// timeout, a rate of zero meaning nothing was received for that long.
+type stallWatchdog struct {
+	timeout   time.Duration
+	reconnect bool
+	blocks    *ratecounter.RateCounter
+
+	lock            sync.Mutex
+	cancelStream    context.CancelFunc
+	streamStartedAt time.Time
+}
+
+func newStallWatchdog(timeout time.Duration, reconnect bool) *stallWatchdog {
+	return &stallWatchdog{
+		timeout:   timeout,
+		reconnect: reconnect,
+		blocks:    ratecounter.NewRateCounter(timeout),
+	}
+}
+
+// streamStarted must be called each time a new stream is started, cancelStream
+// being used to force a reconnection when the stream is deemed stalled.
+func (w *stallWatchdog) streamStarted(cancelStream context.CancelFunc) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.cancelStream = cancelStream
+	w.streamStartedAt = time.Now()
+}
+
+func (w *stallWatchdog) recordBlock() {
+	w.blocks.Incr(1)
+}
+
+func (w *stallWatchdog) run(ctx context.Context, checkEvery time.Duration) {
+	ticker := time.NewTicker(checkEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+func (w *stallWatchdog) check() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.streamStartedAt.IsZero() || time.Since(w.streamStartedAt) < w.timeout || w.blocks.Rate() > 0 {
+		return
+	}
+
+	zlog.Warn("Stream appears stalled", zap.Duration("stall_timeout", w.timeout), zap.Bool("reconnect", w.reconnect))
+	if w.reconnect && w.cancelStream != nil {
+		w.cancelStream()
+		w.cancelStream = nil
+	}
+}
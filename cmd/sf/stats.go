@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/status"
+)
+
+type stats struct {
+	startTime        time.Time
+	timeToFirstBlock time.Duration
+	blockReceived    *counter
+	bytesReceived    *counter
+	restartCount     *counter
+
+	// Blocks and bytes received broken down by the endpoint they were received from
+	endpoints     map[string]*endpointStats
+	endpointOrder []string
+
+	// Stream errors received broken down by their gRPC status code (ex: Unavailable)
+	errors     map[string]uint64
+	errorOrder []string
+
+	// Matching transactions written broken down by the address they were sent
+	// to, only tracked when --address-stats is set
+	addressMatches map[string]uint64
+}
+
+type endpointStats struct {
+	blockReceived *counter
+	bytesReceived *counter
+}
+
+func newEndpointStats() *endpointStats {
+	return &endpointStats{
+		blockReceived: &counter{0, ratecounter.NewRateCounter(1 * time.Second), "block", "s"},
+		bytesReceived: &counter{0, ratecounter.NewRateCounter(1 * time.Second), "byte", "s"},
+	}
+}
+
+func (s *endpointStats) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
+	encoder.AddString("block", s.blockReceived.String())
+	encoder.AddString("bytes", s.bytesReceived.String())
+	return nil
+}
+
+func newStats() *stats {
+	return &stats{
+		startTime:      time.Now(),
+		blockReceived:  &counter{0, ratecounter.NewRateCounter(1 * time.Second), "block", "s"},
+		bytesReceived:  &counter{0, ratecounter.NewRateCounter(1 * time.Second), "byte", "s"},
+		restartCount:   &counter{0, ratecounter.NewRateCounter(1 * time.Minute), "restart", "m"},
+		endpoints:      map[string]*endpointStats{},
+		errors:         map[string]uint64{},
+		addressMatches: map[string]uint64{},
+	}
+}
+
+func (s *stats) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
+	encoder.AddString("block", s.blockReceived.String())
+	encoder.AddString("bytes", s.bytesReceived.String())
+	encoder.AddUint64("avg_block_size", s.averageBlockSize())
+	encoder.AddObject("endpoints", zapcore.ObjectMarshalerFunc(func(encoder zapcore.ObjectEncoder) error {
+		for _, endpoint := range s.endpointOrder {
+			if err := encoder.AddObject(endpoint, s.endpoints[endpoint]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if len(s.errorOrder) > 0 {
+		encoder.AddObject("errors", zapcore.ObjectMarshalerFunc(func(encoder zapcore.ObjectEncoder) error {
+			for _, code := range s.errorOrder {
+				encoder.AddUint64(code, s.errors[code])
+			}
+			return nil
+		}))
+	}
+	return nil
+}
+
+// averageBlockSize returns the average payload size in bytes of the blocks
+// received so far, 0 if no block was received yet.
+func (s *stats) averageBlockSize() uint64 {
+	if s.blockReceived.total == 0 {
+		return 0
+	}
+
+	return s.bytesReceived.total / s.blockReceived.total
+}
+
+func (s *stats) duration() time.Duration {
+	return time.Now().Sub(s.startTime)
+}
+
+func (s *stats) recordBlock(endpoint string, payloadSize int64) {
+
+	if s.timeToFirstBlock == 0 {
+		s.timeToFirstBlock = time.Now().Sub(s.startTime)
+	}
+
+	s.blockReceived.IncBy(1)
+	s.bytesReceived.IncBy(payloadSize)
+
+	segment, found := s.endpoints[endpoint]
+	if !found {
+		segment = newEndpointStats()
+		s.endpoints[endpoint] = segment
+		s.endpointOrder = append(s.endpointOrder, endpoint)
+	}
+
+	segment.blockReceived.IncBy(1)
+	segment.bytesReceived.IncBy(payloadSize)
+}
+
+// recordError counts a stream error under its gRPC status code, errors not
+// coming from gRPC are counted as Unknown.
+func (s *stats) recordError(err error) {
+	code := status.Code(err).String()
+	if _, found := s.errors[code]; !found {
+		s.errorOrder = append(s.errorOrder, code)
+	}
+
+	s.errors[code]++
+}
+
+// recordAddressMatches counts each transaction of the block under the address
+// it was sent to, contract creations having no such address are not counted
+func (s *stats) recordAddressMatches(block *pbcodec.Block) {
+	for _, trxTrace := range block.TransactionTraces {
+		if len(trxTrace.To) == 0 {
+			continue
+		}
+
+		s.addressMatches["0x"+hex.EncodeToString(trxTrace.To)]++
+	}
+}
+
+type addressMatchCount struct {
+	Address string `json:"address"`
+	Matches uint64 `json:"matches"`
+}
+
+// sortedAddressMatches returns the address match counts, busiest first
+func (s *stats) sortedAddressMatches() (out []addressMatchCount) {
+	for address, matches := range s.addressMatches {
+		out = append(out, addressMatchCount{address, matches})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Matches == out[j].Matches {
+			return out[i].Address < out[j].Address
+		}
+		return out[i].Matches > out[j].Matches
+	})
+	return out
+}
+
+func printStats(stats *stats) {
+	elapsed := stats.duration()
+
+	println("")
+	println("Completed streaming")
+	printf("Duration: %s\n", elapsed)
+	printf("Time to first block: %s\n", stats.timeToFirstBlock)
+	if stats.restartCount.total > 0 {
+		printf("Restart count: %s\n", stats.restartCount.Overall(elapsed))
+	}
+	for _, code := range stats.errorOrder {
+		printf("Stream errors %s: %d\n", code, stats.errors[code])
+	}
+
+	println("")
+	printf("Block received: %s\n", stats.blockReceived.Overall(elapsed))
+	printf("Bytes received: %s\n", stats.bytesReceived.Overall(elapsed))
+	printf("Average block size: %d bytes\n", stats.averageBlockSize())
+	if len(stats.endpointOrder) > 1 {
+		for _, endpoint := range stats.endpointOrder {
+			segment := stats.endpoints[endpoint]
+
+			println("")
+			printf("Endpoint %s\n", endpoint)
+			printf("  Block received: %s\n", segment.blockReceived.Overall(elapsed))
+			printf("  Bytes received: %s\n", segment.bytesReceived.Overall(elapsed))
+		}
+	}
+
+	if len(stats.addressMatches) > 0 {
+		println("")
+		println("Matching transactions by address:")
+		for _, count := range stats.sortedAddressMatches() {
+			printf("  %s: %d\n", count.Address, count.Matches)
+		}
+	}
+}
+
+type statsSummary struct {
+	DurationMs         int64               `json:"duration_ms"`
+	TimeToFirstBlockMs int64               `json:"time_to_first_block_ms"`
+	RestartCount       uint64              `json:"restart_count"`
+	BlockReceived      uint64              `json:"block_received"`
+	BytesReceived      uint64              `json:"bytes_received"`
+	AverageBlockSize   uint64              `json:"avg_block_size"`
+	Errors             map[string]uint64   `json:"errors,omitempty"`
+	AddressMatches     []addressMatchCount `json:"address_matches,omitempty"`
+}
+
+func printJSONStats(stats *stats) {
+	out, err := json.Marshal(statsSummary{
+		DurationMs:         stats.duration().Milliseconds(),
+		TimeToFirstBlockMs: stats.timeToFirstBlock.Milliseconds(),
+		RestartCount:       stats.restartCount.Total(),
+		BlockReceived:      stats.blockReceived.Total(),
+		BytesReceived:      stats.bytesReceived.Total(),
+		AverageBlockSize:   stats.averageBlockSize(),
+		Errors:             stats.errors,
+		AddressMatches:     stats.sortedAddressMatches(),
+	})
+	noError(err, "unable to marshal stats to JSON")
+
+	println(string(out))
+}
+
+// statsSnapshot is appended as a JSON line to the --stats-file at each status
+type statsSnapshot struct {
+	Timestamp     string `json:"timestamp"`
+	BlockNum      uint64 `json:"block_num"`
+	BlocksPerSec  int64  `json:"blocks_per_sec"`
+	BytesPerSec   int64  `json:"bytes_per_sec"`
+	BlockReceived uint64 `json:"block_received"`
+	BytesReceived uint64 `json:"bytes_received"`
+	RestartCount  uint64 `json:"restart_count"`
+}
+
+func writeStatsSnapshot(writer io.Writer, stats *stats, blockNum uint64) {
+	out, err := json.Marshal(statsSnapshot{
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+		BlockNum:      blockNum,
+		BlocksPerSec:  stats.blockReceived.Rate(),
+		BytesPerSec:   stats.bytesReceived.Rate(),
+		BlockReceived: stats.blockReceived.Total(),
+		BytesReceived: stats.bytesReceived.Total(),
+		RestartCount:  stats.restartCount.Total(),
+	})
+	noError(err, "unable to marshal stats snapshot to JSON")
+
+	if _, err := writer.Write(append(out, '\n')); err != nil {
+		zlog.Warn("Unable to write stats snapshot", zap.Error(err))
+	}
+}
+
+type counter struct {
+	total    uint64
+	counter  *ratecounter.RateCounter
+	unit     string
+	timeUnit string
+}
+
+func (c *counter) IncBy(value int64) {
+	if value <= 0 {
+		return
+	}
+
+	c.counter.Incr(value)
+	c.total += uint64(value)
+}
+
+func (c *counter) Total() uint64 {
+	return c.total
+}
+
+func (c *counter) Rate() int64 {
+	return c.counter.Rate()
+}
+
+func (c *counter) String() string {
+	return fmt.Sprintf("%d %s/%s (%d total)", c.counter.Rate(), c.unit, c.timeUnit, c.total)
+}
+
+func (c *counter) Overall(elapsed time.Duration) string {
+	rate := float64(c.total)
+	if elapsed.Minutes() > 1 {
+		rate = rate / elapsed.Minutes()
+	}
+
+	return fmt.Sprintf("%d %s/%s (%d %s total)", uint64(rate), c.unit, "min", c.total, c.unit)
+}
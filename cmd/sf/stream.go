@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/big"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/ptypes"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/credentials/oauth"
+)
+
+// streamSetup holds what the receive loop needs beside the flags, resolved
+// from the arguments and the environment by main.
+type streamSetup struct {
+	endpoints   []string
+	clients     []pbbstream.BlockStreamV2Client
+	token       func(ctx context.Context) (string, error)
+	authBreaker *authCircuitBreaker
+
+	brange        blockRange
+	cursor        string
+	filter        string
+	topics        map[string]bool
+	minAmount     *big.Int
+	fallbackBlock int64
+}
+
+// streamBlocks streams the blocks of the range from the endpoints, rotating
+// among them and reconnecting from the last written cursor on errors, writing
+// them to the output selected by the flags until the range is complete or ctx
+// is cancelled. It returns the stats of the run and the last written cursor.
+func streamBlocks(ctx context.Context, setup streamSetup) (*stats, string) {
+	endpoints, streamClients, authBreaker := setup.endpoints, setup.clients, setup.authBreaker
+	brange, cursor, filter, topics, fallbackBlock := setup.brange, setup.cursor, setup.filter, setup.topics, setup.fallbackBlock
+
+	stats := newStats()
+	var statsFile *os.File
+	if *flagStatsFile != "" {
+		var err error
+		statsFile, err = os.OpenFile(*flagStatsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		noErrorWithCode(exitOutput, err, "unable to open stats file %q", *flagStatsFile)
+		defer statsFile.Close()
+	}
+
+	// Offsetting the first status by up to half the status frequency staggers
+	// the status logs of many instances started at the same moment
+	jitter := time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(statusFrequency / 2)))
+	nextStatus := time.Now().Add(statusFrequency + jitter)
+	nextHeartbeat := time.Now().Add(*flagHeartbeat)
+	explorerURLs := explorerTransactionURLs()
+
+	// Transaction traces are removed from the blocks unless they pass all of these filters
+	var trxFilters []func(*pbcodec.TransactionTrace) bool
+	if *flagOnlySuccessful {
+		trxFilters = append(trxFilters, succeeded)
+	}
+	if setup.minAmount != nil {
+		trxFilters = append(trxFilters, transfersAtLeast(setup.minAmount))
+	}
+	if len(topics) > 0 {
+		trxFilters = append(trxFilters, hasTopic(topics))
+	}
+	if *flagMinGas > 0 {
+		trxFilters = append(trxFilters, usesGas(*flagMinGas))
+	}
+
+	var order *orderVerifier
+	if *flagVerifyOrder {
+		order = &orderVerifier{}
+	}
+	// The order verification state once the last written block was checked
+	var writtenOrder orderVerifier
+
+	writer, closer := blockWriter(brange)
+	writerPath := outputPath(brange)
+	blockDir := blockFileDir(brange)
+	var recordsWritten uint64
+	verifyOutput := !*flagNoVerify && !*flagPretty && writer != nil && *flagS3Bucket == "" && *flagWebhookURL == "" && *flagPubsubProject == "" && *flagFormat != "proto-stream" && writerPath != "-"
+	nextRotation := outputTime.Add(*flagRotateInterval)
+
+	var confirmations *confirmationBuffer
+	if *flagMinConfirmations > 0 {
+		confirmations = &confirmationBuffer{depth: *flagMinConfirmations}
+	}
+
+	emit := func(p pendingBlock) {
+		if p.sampled && *flagPrintLinks {
+			printTransactionLinks(p.response, p.block, explorerURLs)
+		}
+		if p.sampled && *flagAddressStats && p.response.Step != pbbstream.ForkStep_STEP_UNDO {
+			stats.recordAddressMatches(p.block)
+		}
+
+		switch {
+		case !p.sampled:
+		case blockDir != "":
+			writeBlockFile(blockDir, p.response, p.block)
+		case writer != nil && *flagFormat == "trx-json":
+			recordsWritten += uint64(writeTransactions(writer, p.response, p.block))
+		case writer != nil && *flagFormat == "storage-changes":
+			recordsWritten += uint64(writeStorageChanges(writer, p.response, p.block))
+		case writer != nil && *flagFormat == "native-transfers":
+			recordsWritten += uint64(writeNativeTransfers(writer, p.response, p.block))
+		case writer != nil && *flagFormat == "proto-stream":
+			recordsWritten += uint64(writeProtoStream(writer, p.block))
+		case writer != nil && *flagFormat == "headers":
+			writeHeader(writer, p.response, p.block)
+			recordsWritten++
+		case writer != nil:
+			writeBlock(writer, p.response, p.block)
+			recordsWritten++
+		}
+
+		// Flushing is counted in blocks, whatever the number of records written for each
+		if flushing, ok := writer.(*flushingWriter); ok && p.sampled {
+			noErrorWithCode(exitOutput, flushing.blockWritten(), "unable to flush block %s", p.block.AsRef())
+		}
+
+		cursor = p.response.Cursor
+		writtenOrder = p.order
+	}
+
+	lastBlockRef := bstream.BlockRefEmpty
+
+	var health *healthChecker
+	if *flagHealthListen != "" {
+		health = newHealthChecker(2 * statusFrequency)
+		serveHealth(*flagHealthListen, health)
+	}
+
+	var retries *retryBudget
+	if *flagRetryBudget > 0 {
+		retries = newRetryBudget(*flagRetryBudget, *flagRetryRefillInterval)
+	}
+
+	var watchdog *stallWatchdog
+	if *flagStallTimeout > 0 {
+		watchdog = newStallWatchdog(*flagStallTimeout, *flagStallReconnect)
+		go watchdog.run(ctx, statusFrequency)
+	}
+
+	zlog.Info("Starting stream", zap.Stringer("range", brange), zap.String("cursor", cursor), zap.Strings("endpoints", endpoints), zap.Bool("handle_forks", *flagHandleForks))
+	endpointIndex := 0
+stream:
+	for {
+		if confirmations != nil {
+			// Streaming restarts from the cursor of the last written block, the
+			// blocks held back are sent again and must be verified again
+			confirmations.reset()
+			if order != nil {
+				*order = writtenOrder
+			}
+		}
+
+		endpoint := endpoints[endpointIndex]
+		streamClient := streamClients[endpointIndex]
+
+		token, err := setup.token(ctx)
+		if ctx.Err() != nil {
+			break stream
+		}
+		noErrorWithCode(exitAuth, err, "unable to retrieve StreamingFast API token")
+
+		credentials := oauth.NewOauthAccess(&oauth2.Token{AccessToken: token, TokenType: "Bearer"})
+		streamCtx, cancelStream := context.WithCancel(ctx)
+		if watchdog != nil {
+			watchdog.streamStarted(cancelStream)
+		}
+
+		stream, err := streamClient.Blocks(streamCtx, &pbbstream.BlocksRequestV2{
+			StartBlockNum:     brange.start,
+			StartCursor:       cursor,
+			StopBlockNum:      brange.end,
+			ForkSteps:         requestedForkSteps(),
+			IncludeFilterExpr: filter,
+			Details:           requestedDetails(),
+		}, streamCallOptions(credentials)...)
+		if ctx.Err() != nil {
+			cancelStream()
+			break stream
+		}
+		noErrorWithCode(exitStream, err, "unable to start blocks stream")
+
+		receivedOnStream := false
+		for {
+			zlog.Debug("Waiting for message to reach us")
+			var blockTimer *time.Timer
+			var blockTimedOut int32
+			if *flagBlockTimeout > 0 && receivedOnStream {
+				blockTimer = time.AfterFunc(*flagBlockTimeout, func() {
+					atomic.StoreInt32(&blockTimedOut, 1)
+					cancelStream()
+				})
+			}
+
+			response, err := stream.Recv()
+			if blockTimer != nil {
+				blockTimer.Stop()
+			}
+
+			if err != nil {
+				if err == io.EOF {
+					if confirmations != nil {
+						// The range is complete, no more blocks are coming to confirm the ones held back
+						for _, p := range confirmations.drain() {
+							emit(p)
+						}
+					}
+
+					if *flagThenFollow && brange.end != 0 {
+						zlog.Info("Reached end of range, now following the chain head", zap.Stringer("range", brange), zap.String("cursor", cursor))
+						if cursor == "" {
+							brange.start = int64(brange.end) + 1
+						}
+						brange.end = 0
+
+						cancelStream()
+						continue stream
+					}
+
+					if *flagWaitOnEOF > 0 && (brange.end == 0 || lastBlockRef.Num() < brange.end) {
+						// Not a completion of the range, the server ended the stream before its end block
+						zlog.Info("Stream ended before the end of range, waiting before requesting it again", zap.Stringer("range", brange), zap.Duration("wait_on_eof", *flagWaitOnEOF), zap.String("cursor", cursor), zap.Stringer("last_block", lastBlockRef))
+						cancelStream()
+
+						select {
+						case <-ctx.Done():
+							break stream
+						case <-time.After(*flagWaitOnEOF):
+						}
+						continue stream
+					}
+
+					cancelStream()
+					break stream
+				}
+
+				if ctx.Err() != nil {
+					zlog.Info("Stream cancelled", zap.String("cursor", cursor), zap.Stringer("last_block", lastBlockRef))
+					cancelStream()
+					break stream
+				}
+
+				if atomic.LoadInt32(&blockTimedOut) == 1 {
+					zlog.Warn("No block received within block timeout, reconnecting", zap.Duration("block_timeout", *flagBlockTimeout), zap.String("cursor", cursor), zap.Stringer("last_block", lastBlockRef))
+				}
+
+				stats.recordError(err)
+				authBreaker.record(err)
+				if *flagCursorFallback && cursor != "" && isCursorRejected(err) {
+					zlog.Warn("Start cursor rejected by the server, abandoning it and restarting from fallback block", zap.String("cursor", cursor), zap.Int64("fallback_block", fallbackBlock), zap.Error(err))
+					cursor = ""
+					brange.start = fallbackBlock
+					if order != nil {
+						// Streaming restarts from an unrelated block, the previous head no longer applies
+						*order, writtenOrder = orderVerifier{}, orderVerifier{}
+					}
+
+					cancelStream()
+					continue stream
+				}
+
+				if *flagNoRetry {
+					closeWithin(closer, *flagShutdownTimeout)
+					quitWithCode(exitStream, "Stream encountered a remote error at cursor %q (last block %s), not retrying since --no-retry is set: %s", cursor, lastBlockRef, err)
+				}
+
+				if retries != nil && !retries.spend() {
+					closeWithin(closer, *flagShutdownTimeout)
+					quitWithCode(exitStream, "Stream encountered a remote error at cursor %q (last block %s) with the --retry-budget of %d retries exhausted: %s", cursor, lastBlockRef, *flagRetryBudget, err)
+				}
+
+				zlog.Error("Stream encountered a remote error, going to retry", zap.String("cursor", cursor), zap.Stringer("last_block", lastBlockRef), zap.Duration("retry_delay", retryDelay), zap.Error(err))
+				break
+			}
+
+			zlog.Debug("Decoding received message's block")
+			block, err := decodeBlock(response.Block)
+			if err != nil {
+				// Keep what was written so far, the cursor being the one to resume from once fixed
+				closeWithin(closer, *flagShutdownTimeout)
+				quitWithCode(exitStream, "Unable to decode block received after cursor %q (last block %s): %s", cursor, lastBlockRef, err)
+			}
+
+			receivedOnStream = true
+			if order != nil {
+				noErrorWithCode(exitStream, order.check(response.Step, block), "blocks received out of order")
+			}
+
+			lastBlockRef = block.AsRef()
+			authBreaker.reset()
+			if health != nil {
+				health.recordBlock(lastBlockRef)
+			}
+			if watchdog != nil {
+				watchdog.recordBlock()
+			}
+			payloadSize := int64(response.XXX_Size())
+			sampled := inSample(block, *flagSampleRate)
+
+			var modified bool
+			for _, keep := range trxFilters {
+				if sampled && keepTransactions(block, keep) > 0 {
+					modified = true
+				}
+			}
+			if sampled && *flagMaxTrxsPerBlock > 0 {
+				if removed := keepFirstTransactions(block, *flagMaxTrxsPerBlock); removed > 0 {
+					zlog.Warn("Block truncated, too many transactions", zap.Stringer("block", lastBlockRef), zap.Int("kept", *flagMaxTrxsPerBlock), zap.Int("removed", removed))
+					modified = true
+				}
+			}
+			if sampled && *flagMaxCallDepth >= 0 && keepCallsUpTo(block, uint32(*flagMaxCallDepth)) > 0 {
+				modified = true
+			}
+
+			if sampled && *flagCompactTrace {
+				compactTrace(block)
+				modified = true
+			}
+
+			if modified {
+				response.Block, err = ptypes.MarshalAny(block)
+				noError(err, "unable to re-encode block %s after removing transactions, calls or fields", lastBlockRef)
+			}
+
+			if traceEnabled {
+				zlog.Debug("Block received", zap.Stringer("block", lastBlockRef), zap.Stringer("previous", bstream.NewBlockRefFromID(block.PreviousID())), zap.String("cursor", response.Cursor))
+				traceFilterMatches(block)
+			}
+
+			now := time.Now()
+			if now.After(nextStatus) {
+				zlog.Info("Stream blocks progress", zap.Object("stats", stats), zap.Stringer("last_block", lastBlockRef), zap.String("last_block_time", blockTime(block)))
+				nextStatus = now.Add(statusFrequency)
+				flushOutput(writer)
+				if statsFile != nil {
+					writeStatsSnapshot(statsFile, stats, block.Number)
+				}
+			}
+
+			// Cancellation may have happened while the block was processed, it's then
+			// dropped and the cursor is kept on the last fully processed block.
+			if ctx.Err() != nil {
+				zlog.Info("Stream cancelled, dropping partially processed block", zap.String("cursor", cursor), zap.Stringer("block", lastBlockRef))
+				cancelStream()
+				break stream
+			}
+
+			if *flagRotateInterval > 0 && now.After(nextRotation) {
+				closeWithin(closer, *flagShutdownTimeout)
+				if verifyOutput {
+					verifyRecordCount(writerPath, recordsWritten)
+				}
+
+				outputTime = now
+				writer, closer = blockWriter(brange)
+				writerPath = outputPath(brange)
+				recordsWritten = 0
+				nextRotation = now.Add(*flagRotateInterval)
+				zlog.Info("Rotated output file", zap.String("path", writerPath), zap.Stringer("last_block", lastBlockRef))
+			}
+
+			pending := pendingBlock{response: response, block: block, sampled: sampled}
+			if order != nil {
+				pending.order = *order
+			}
+
+			ready := []pendingBlock{pending}
+			if confirmations != nil {
+				ready = confirmations.push(ready[0])
+			}
+
+			for _, p := range ready {
+				emit(p)
+			}
+			if *flagOnFirstBlock != "" && stats.blockReceived.Total() == 0 {
+				runFirstBlockCommand(*flagOnFirstBlock, block)
+			}
+			stats.recordBlock(endpoint, payloadSize)
+
+			if *flagHeartbeat > 0 && writer != nil && now.After(nextHeartbeat) {
+				writeHeartbeat(writer, block, cursor)
+				recordsWritten++
+				nextHeartbeat = now.Add(*flagHeartbeat)
+			}
+
+			if *flagMaxBytes > 0 && stats.bytesReceived.Total() >= *flagMaxBytes {
+				zlog.Info("Reached maximum amount of bytes to receive, stopping stream", zap.Uint64("max_bytes", *flagMaxBytes), zap.Stringer("last_block", lastBlockRef), zap.String("cursor", cursor))
+				cancelStream()
+				break stream
+			}
+		}
+		cancelStream()
+
+		select {
+		case <-ctx.Done():
+			break stream
+		case <-time.After(retryDelay):
+		}
+		stats.restartCount.IncBy(1)
+
+		if len(endpoints) > 1 {
+			endpointIndex = (endpointIndex + 1) % len(endpoints)
+			zlog.Info("Rotating to next endpoint", zap.String("endpoint", endpoints[endpointIndex]))
+		}
+	}
+
+	closeWithin(closer, *flagShutdownTimeout)
+	if verifyOutput {
+		verifyRecordCount(writerPath, recordsWritten)
+	}
+
+	return stats, cursor
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/ptypes"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeStep is either a response sent to the client, an error ending the
+// stream with it or a pause running a check before the next step
+type fakeStep struct {
+	response *pbbstream.BlockResponseV2
+	err      error
+	pause    func()
+}
+
+// fakeBlockStream is a BlockStreamV2 server playing one scripted session per
+// received request, a session ending without error being a completed range.
+type fakeBlockStream struct {
+	mu       sync.Mutex
+	sessions [][]fakeStep
+	requests []*pbbstream.BlocksRequestV2
+}
+
+func (s *fakeBlockStream) Blocks(request *pbbstream.BlocksRequestV2, stream pbbstream.BlockStreamV2_BlocksServer) error {
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	if len(s.sessions) == 0 {
+		s.mu.Unlock()
+		return status.Error(codes.Unavailable, "no more scripted sessions")
+	}
+	session := s.sessions[0]
+	s.sessions = s.sessions[1:]
+	s.mu.Unlock()
+
+	for _, step := range session {
+		if step.pause != nil {
+			step.pause()
+			continue
+		}
+		if step.err != nil {
+			return step.err
+		}
+		if err := stream.Send(step.response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fakeBlock(t *testing.T, step pbbstream.ForkStep, num uint64, id string) fakeStep {
+	t.Helper()
+
+	return fakeBlockWithTransactions(t, step, num, id, 0)
+}
+
+// fakeBlockWithTransactions is a fakeBlock holding trxCount successful
+// transaction traces
+func fakeBlockWithTransactions(t *testing.T, step pbbstream.ForkStep, num uint64, id string, trxCount int) fakeStep {
+	t.Helper()
+
+	block := &pbcodec.Block{
+		Number: num,
+		Hash:   []byte(id),
+		Header: &pbcodec.BlockHeader{Number: num, Timestamp: ptypes.TimestampNow()},
+	}
+	for i := 0; i < trxCount; i++ {
+		block.TransactionTraces = append(block.TransactionTraces, &pbcodec.TransactionTrace{
+			Hash:   []byte(fmt.Sprintf("%s-trx-%d", id, i)),
+			Index:  uint32(i),
+			Status: pbcodec.TransactionTraceStatus_SUCCEEDED,
+		})
+	}
+
+	payload, err := ptypes.MarshalAny(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fakeStep{response: &pbbstream.BlockResponseV2{Block: payload, Step: step, Cursor: "cursor-" + id}}
+}
+
+// startFakeBlockStream serves the fake over an in-memory listener, TLS being
+// required by the per call OAuth credentials, and returns a client to it.
+func startFakeBlockStream(t *testing.T, server *fakeBlockStream) pbbstream.BlockStreamV2Client {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"bufnet"}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&certificate)))
+	pbbstream.RegisterBlockStreamV2Server(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return pbbstream.NewBlockStreamV2Client(conn)
+}
+
+// runFakeStream streams the range from the fake writing to a temporary -o
+// file and returns the written records along the stats and last cursor.
+func runFakeStream(t *testing.T, server *fakeBlockStream, brange blockRange) (records []map[string]interface{}, stats *stats, cursor string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sf-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "blocks.jsonl")
+	previousWrite, previousDelay := *flagWrite, retryDelay
+	*flagWrite, retryDelay = out, 10*time.Millisecond
+	defer func() { *flagWrite, retryDelay = previousWrite, previousDelay }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stats, cursor = streamBlocks(ctx, streamSetup{
+		endpoints:   []string{"bufnet"},
+		clients:     []pbbstream.BlockStreamV2Client{startFakeBlockStream(t, server)},
+		token:       func(ctx context.Context) (string, error) { return "token", nil },
+		authBreaker: &authCircuitBreaker{},
+		brange:      brange,
+	})
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("record %q is not JSON: %s", line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, stats, cursor
+}
+
+func TestStreamBlocksReconnectsFromLastCursor(t *testing.T) {
+	server := &fakeBlockStream{sessions: [][]fakeStep{
+		{
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 1, "a1"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 2, "a2"),
+			{err: status.Error(codes.Unavailable, "connection reset")},
+		},
+		{
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 3, "a3"),
+		},
+	}}
+
+	records, stats, cursor := runFakeStream(t, server, blockRange{start: 1, end: 3})
+
+	if len(server.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(server.requests))
+	}
+	if server.requests[0].StartBlockNum != 1 || server.requests[0].StopBlockNum != 3 || server.requests[0].StartCursor != "" {
+		t.Errorf("unexpected first request %s", server.requests[0])
+	}
+	if server.requests[1].StartCursor != "cursor-a2" {
+		t.Errorf("expected reconnection from cursor %q, got %q", "cursor-a2", server.requests[1].StartCursor)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	if cursor != "cursor-a3" {
+		t.Errorf("expected last cursor %q, got %q", "cursor-a3", cursor)
+	}
+	if stats.restartCount.Total() != 1 {
+		t.Errorf("expected 1 restart, got %d", stats.restartCount.Total())
+	}
+	if stats.blockReceived.Total() != 3 {
+		t.Errorf("expected 3 blocks received, got %d", stats.blockReceived.Total())
+	}
+}
+
+func TestStreamBlocksForkSteps(t *testing.T) {
+	previous := *flagHandleForks
+	*flagHandleForks = true
+	defer func() { *flagHandleForks = previous }()
+
+	server := &fakeBlockStream{sessions: [][]fakeStep{
+		{
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 1, "a1"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 2, "a2"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_UNDO, 2, "a2"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 2, "b2"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_IRREVERSIBLE, 1, "a1"),
+		},
+	}}
+
+	records, _, cursor := runFakeStream(t, server, blockRange{start: 1, end: 2})
+
+	steps := server.requests[0].ForkSteps
+	if len(steps) != 3 {
+		t.Errorf("expected NEW, IRREVERSIBLE and UNDO steps to be requested, got %s", steps)
+	}
+
+	var actual []string
+	for _, record := range records {
+		actual = append(actual, record["step"].(string))
+	}
+	expected := "STEP_NEW,STEP_NEW,STEP_UNDO,STEP_NEW,STEP_IRREVERSIBLE"
+	if strings.Join(actual, ",") != expected {
+		t.Fatalf("expected steps %s, got %s", expected, strings.Join(actual, ","))
+	}
+	if records[2]["undo"] != true || records[2]["block_num"] != float64(2) {
+		t.Errorf("expected an undo record of block #2, got %v", records[2])
+	}
+	if cursor != "cursor-a1" {
+		t.Errorf("expected last cursor %q, got %q", "cursor-a1", cursor)
+	}
+}
+
+func TestStreamBlocksConfirmationsReconnectVerifyOrder(t *testing.T) {
+	previousForks, previousOrder, previousConfirmations := *flagHandleForks, *flagVerifyOrder, *flagMinConfirmations
+	*flagHandleForks, *flagVerifyOrder, *flagMinConfirmations = true, true, 1
+	defer func() {
+		*flagHandleForks, *flagVerifyOrder, *flagMinConfirmations = previousForks, previousOrder, previousConfirmations
+	}()
+
+	server := &fakeBlockStream{sessions: [][]fakeStep{
+		{
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 1, "a1"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 2, "a2"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 3, "a3"),
+			{err: status.Error(codes.Unavailable, "connection reset")},
+		},
+		{
+			// Block #3 was held back, the stream restarts after the last written block #2
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 3, "a3"),
+			fakeBlock(t, pbbstream.ForkStep_STEP_NEW, 4, "a4"),
+		},
+	}}
+
+	records, _, cursor := runFakeStream(t, server, blockRange{start: 1, end: 4})
+
+	if len(server.requests) != 2 || server.requests[1].StartCursor != "cursor-a2" {
+		t.Fatalf("expected reconnection from cursor %q, got requests %v", "cursor-a2", server.requests)
+	}
+
+	var actual []string
+	for _, record := range records {
+		actual = append(actual, record["cursor"].(string))
+	}
+	expected := "cursor-a1,cursor-a2,cursor-a3,cursor-a4"
+	if strings.Join(actual, ",") != expected {
+		t.Fatalf("expected records %s, got %s", expected, strings.Join(actual, ","))
+	}
+	if cursor != "cursor-a4" {
+		t.Errorf("expected last cursor %q, got %q", "cursor-a4", cursor)
+	}
+}
+
+func TestStreamBlocksFlushEveryCountsBlocks(t *testing.T) {
+	previousFormat, previousFlushEvery := *flagFormat, *flagFlushEvery
+	*flagFormat, *flagFlushEvery = "trx-json", "2"
+	defer func() { *flagFormat, *flagFlushEvery = previousFormat, previousFlushEvery }()
+
+	var flushedLines int
+	server := &fakeBlockStream{sessions: [][]fakeStep{
+		{
+			fakeBlockWithTransactions(t, pbbstream.ForkStep_STEP_NEW, 1, "a1", 3),
+			fakeBlockWithTransactions(t, pbbstream.ForkStep_STEP_NEW, 2, "a2", 2),
+			{pause: func() {
+				// Both blocks are flushed at once, never some of their records only
+				for deadline := time.Now().Add(5 * time.Second); flushedLines == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+					content, _ := ioutil.ReadFile(*flagWrite)
+					flushedLines = strings.Count(string(content), "\n")
+				}
+			}},
+			fakeBlockWithTransactions(t, pbbstream.ForkStep_STEP_NEW, 3, "a3", 3),
+		},
+	}}
+
+	records, _, _ := runFakeStream(t, server, blockRange{start: 1, end: 3})
+
+	if flushedLines != 5 {
+		t.Errorf("expected the first flush to write the 5 records of the first 2 blocks, got %d records", flushedLines)
+	}
+	if len(records) != 8 {
+		t.Errorf("expected 8 records, got %d", len(records))
+	}
+}
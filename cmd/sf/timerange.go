@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/ptypes"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// blockFetcher fetches a single block, `num` being resolved like the request's
+// `StartBlockNum`, so a negative value is relative to the chain head.
+type blockFetcher func(ctx context.Context, num int64) (*pbcodec.Block, error)
+
+func newBlockFetcher(streamClient pbbstream.BlockStreamV2Client, callOptions ...grpc.CallOption) blockFetcher {
+	return func(ctx context.Context, num int64) (*pbcodec.Block, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		request := &pbbstream.BlocksRequestV2{
+			StartBlockNum: num,
+			ForkSteps:     []pbbstream.ForkStep{pbbstream.ForkStep_STEP_NEW},
+			Details:       pbbstream.BlockDetails_BLOCK_DETAILS_LIGHT,
+		}
+		if num >= 0 {
+			request.StopBlockNum = uint64(num)
+		}
+
+		stream, err := streamClient.Blocks(ctx, request, callOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("start blocks stream: %w", err)
+		}
+
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no block received for block #%d", num)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receive block: %w", err)
+		}
+
+		return decodeBlock(response.Block)
+	}
+}
+
+// resolveTimeRange resolves the block range covering [startTime, endTime], a
+// zero endTime leaving the range unbounded. The StreamingFast API has no way to
+// look up a block by time so a binary search over block headers is performed,
+// each step fetching a single block.
+func resolveTimeRange(ctx context.Context, fetch blockFetcher, startTime, endTime time.Time) (out blockRange, err error) {
+	head, err := fetch(ctx, -1)
+	if err != nil {
+		return out, fmt.Errorf("fetch head block: %w", err)
+	}
+
+	start, err := firstBlockAfter(ctx, fetch, head, startTime, false)
+	if err != nil {
+		return out, fmt.Errorf("resolve start time %s: %w", startTime, err)
+	}
+	out.start = int64(start)
+
+	if !endTime.IsZero() {
+		// The end block is the last one at or before end time, so the one right before
+		// the first block strictly after it
+		end, err := firstBlockAfter(ctx, fetch, head, endTime, true)
+		if err != nil {
+			return out, fmt.Errorf("resolve end time %s: %w", endTime, err)
+		}
+
+		if end > 0 {
+			end--
+		}
+
+		if end <= start {
+			return out, fmt.Errorf("no blocks between start time %s and end time %s", startTime, endTime)
+		}
+		out.end = end
+	}
+
+	zlog.Info("Resolved time range to block range", zap.Time("start_time", startTime), zap.Time("end_time", endTime), zap.Stringer("range", out))
+	return out, nil
+}
+
+// firstBlockAfter returns the number of the first block whose timestamp is
+// after `at` (or equal to it when not strict), the head block's number + 1 if
+// no such block exist yet.
+func firstBlockAfter(ctx context.Context, fetch blockFetcher, head *pbcodec.Block, at time.Time, strict bool) (uint64, error) {
+	isAfter := func(block *pbcodec.Block) (bool, error) {
+		blockTime, err := ptypes.Timestamp(block.Header.Timestamp)
+		if err != nil {
+			return false, fmt.Errorf("invalid block #%d timestamp: %w", block.Number, err)
+		}
+
+		if strict {
+			return blockTime.After(at), nil
+		}
+		return !blockTime.Before(at), nil
+	}
+
+	after, err := isAfter(head)
+	if err != nil || !after {
+		return head.Number + 1, err
+	}
+
+	low, high := uint64(0), head.Number
+	for low < high {
+		middle := low + (high-low)/2
+
+		block, err := fetch(ctx, int64(middle))
+		if err != nil {
+			return 0, fmt.Errorf("fetch block #%d: %w", middle, err)
+		}
+
+		after, err := isAfter(block)
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case after && block.Number > middle:
+			// Requesting a block before the first streamable block of the chain gives
+			// back the first streamable block instead, no earlier block can be streamed
+			return block.Number, nil
+		case after:
+			high = middle
+		default:
+			low = block.Number + 1
+		}
+	}
+
+	return low, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+var fakeGenesisTime = time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeChain is a blockFetcher over blocks [first, head] produced every 10
+// seconds from fakeGenesisTime, requests before first giving back first.
+func fakeChain(t *testing.T, first, head uint64) blockFetcher {
+	return func(ctx context.Context, num int64) (*pbcodec.Block, error) {
+		switch {
+		case num < 0:
+			num = int64(head) + 1 + num
+		case uint64(num) < first:
+			num = int64(first)
+		}
+
+		timestamp, err := ptypes.TimestampProto(fakeBlockTime(uint64(num)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pbcodec.Block{Number: uint64(num), Header: &pbcodec.BlockHeader{Number: uint64(num), Timestamp: timestamp}}, nil
+	}
+}
+
+func fakeBlockTime(num uint64) time.Time {
+	return fakeGenesisTime.Add(time.Duration(num) * 10 * time.Second)
+}
+
+func TestFirstBlockAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    uint64
+		at       time.Time
+		strict   bool
+		expected uint64
+	}{
+		{"exact block time", 0, fakeBlockTime(42), false, 42},
+		{"exact block time strict", 0, fakeBlockTime(42), true, 43},
+		{"between blocks", 0, fakeBlockTime(42).Add(5 * time.Second), false, 43},
+		{"before genesis", 0, fakeGenesisTime.Add(-time.Hour), false, 0},
+		{"after head", 0, fakeBlockTime(101), false, 101},
+		{"before first streamable block", 80, fakeGenesisTime, false, 80},
+		{"at first streamable block", 80, fakeBlockTime(80), false, 80},
+		{"after first streamable block", 80, fakeBlockTime(90), false, 90},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			fetch := fakeChain(t, test.first, 100)
+			head, _ := fetch(ctx, -1)
+
+			actual, err := firstBlockAfter(ctx, fetch, head, test.at, test.strict)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected block #%d, got #%d", test.expected, actual)
+			}
+		})
+	}
+}
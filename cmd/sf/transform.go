@@ -0,0 +1,160 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/big"
+
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+)
+
+// keepTransactions removes from the block every transaction trace for which
+// keep is false and returns the number of removed traces.
+func keepTransactions(block *pbcodec.Block, keep func(*pbcodec.TransactionTrace) bool) (removed int) {
+	kept := block.TransactionTraces[:0]
+	for _, trxTrace := range block.TransactionTraces {
+		if !keep(trxTrace) {
+			removed++
+			continue
+		}
+
+		kept = append(kept, trxTrace)
+	}
+
+	block.TransactionTraces = kept
+	return
+}
+
+// succeeded tells if the transaction trace `status` field is `SUCCEEDED`,
+// transactions that `FAILED` (ran out of gas, invalid opcode, etc.), that were
+// `REVERTED` or for which status is `UNKNOWN` are not successful.
+func succeeded(trxTrace *pbcodec.TransactionTrace) bool {
+	return trxTrace.Status == pbcodec.TransactionTraceStatus_SUCCEEDED
+}
+
+// transfersAtLeast returns a predicate telling if at least one call of the
+// transaction trace emits an ERC20 transfer event of minAmount or more, in
+// token base units.
+func transfersAtLeast(minAmount *big.Int) func(*pbcodec.TransactionTrace) bool {
+	return func(trxTrace *pbcodec.TransactionTrace) bool {
+		for _, call := range trxTrace.Calls {
+			for _, event := range call.Erc20TransferEvents {
+				if transferAmount(event).Cmp(minAmount) >= 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// transferAmount is the amount of the ERC20 transfer event, its big-endian
+// bytes being unsigned, 0 when absent.
+func transferAmount(event *pbcodec.ERC20TransferEvent) *big.Int {
+	if event.Amount == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).SetBytes(event.Amount.Bytes)
+}
+
+// hasTopic returns a predicate telling if at least one log of the transaction
+// trace, either from its receipt or from one of its calls, has a first topic
+// (the event signature hash) part of topics.
+func hasTopic(topics map[string]bool) func(*pbcodec.TransactionTrace) bool {
+	matches := func(logs []*pbcodec.Log) bool {
+		for _, log := range logs {
+			if len(log.Topics) > 0 && topics[string(log.Topics[0])] {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(trxTrace *pbcodec.TransactionTrace) bool {
+		if trxTrace.Receipt != nil && matches(trxTrace.Receipt.Logs) {
+			return true
+		}
+
+		for _, call := range trxTrace.Calls {
+			if matches(call.Logs) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// usesGas returns a predicate telling if the transaction trace used at least
+// minGas gas.
+func usesGas(minGas uint64) func(*pbcodec.TransactionTrace) bool {
+	return func(trxTrace *pbcodec.TransactionTrace) bool {
+		return trxTrace.GasUsed >= minGas
+	}
+}
+
+// keepFirstTransactions truncates the transaction traces of the block to the
+// first max ones and returns the number of removed traces.
+func keepFirstTransactions(block *pbcodec.Block, max int) (removed int) {
+	if len(block.TransactionTraces) <= max {
+		return 0
+	}
+
+	removed = len(block.TransactionTraces) - max
+	block.TransactionTraces = block.TransactionTraces[:max]
+	return
+}
+
+// keepCallsUpTo removes from each transaction trace of the block the calls
+// nested deeper than maxDepth, the root call of a transaction being at depth 0,
+// and returns the number of removed calls. Parents always being shallower than
+// their children, kept calls never reference a removed parent.
+func keepCallsUpTo(block *pbcodec.Block, maxDepth uint32) (removed int) {
+	for _, trxTrace := range block.TransactionTraces {
+		kept := trxTrace.Calls[:0]
+		for _, call := range trxTrace.Calls {
+			if call.Depth > maxDepth {
+				removed++
+				continue
+			}
+
+			kept = append(kept, call)
+		}
+
+		trxTrace.Calls = kept
+	}
+
+	return
+}
+
+// compactTrace strips from the block the fields that are the bulk of full
+// blocks, the inputs and logs of transactions and calls along the storage
+// changes of calls.
+func compactTrace(block *pbcodec.Block) {
+	for _, trxTrace := range block.TransactionTraces {
+		trxTrace.Input = nil
+		if trxTrace.Receipt != nil {
+			trxTrace.Receipt.Logs = nil
+		}
+
+		for _, call := range trxTrace.Calls {
+			call.Input = nil
+			call.Logs = nil
+			call.StorageChanges = nil
+		}
+	}
+}
+
+// inSample tells if the block is part of the sample when only a fraction
+// `rate` of the blocks is kept. The decision is derived from the block's hash
+// so the different fork steps of a given block always end up with the same
+// decision.
+func inSample(block *pbcodec.Block, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+
+	hash := fnv.New64a()
+	hash.Write(block.Hash)
+
+	return float64(hash.Sum64()) < rate*math.MaxUint64
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const webhookAttempts = 3
+
+// webhookWriter accumulates the records written to it and POSTs them, by
+// batches, as a JSON array to a webhook URL. A batch still failing after all
+// attempts is logged and dropped so the stream keeps going.
+type webhookWriter struct {
+	url       string
+	batchSize int
+	client    *http.Client
+
+	record  bytes.Buffer
+	records [][]byte
+}
+
+func newWebhookWriter(url string, batchSize int) *webhookWriter {
+	return &webhookWriter{url: url, batchSize: batchSize, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (w *webhookWriter) Write(p []byte) (int, error) {
+	return w.record.Write(p)
+}
+
+// recordWritten completes the record being written, the batch being posted
+// once it holds enough records.
+func (w *webhookWriter) recordWritten() {
+	record := bytes.TrimSuffix(w.record.Bytes(), endOfLine)
+	w.records = append(w.records, append([]byte(nil), record...))
+	w.record.Reset()
+
+	if len(w.records) >= w.batchSize {
+		w.flush()
+	}
+}
+
+func (w *webhookWriter) flush() {
+	if len(w.records) == 0 {
+		return
+	}
+
+	body := append([]byte("["), bytes.Join(w.records, []byte(","))...)
+	body = append(body, ']')
+
+	err := sendWithRetries("Webhook delivery", w.url, webhookAttempts, func() (bool, error) { return w.post(body) })
+	if err != nil {
+		zlog.Error("Webhook delivery failed, dropping batch", zap.String("url", w.url), zap.Int("record_count", len(w.records)), zap.Error(err))
+	}
+
+	w.records = w.records[:0]
+}
+
+// post sends the batch once, telling when failing if the delivery is worth
+// retrying, which is the case of network errors and 5xx responses.
+func (w *webhookWriter) post(body []byte) (retryable bool, err error) {
+	response, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 300 {
+		return response.StatusCode >= 500, fmt.Errorf("webhook responded with status %s", response.Status)
+	}
+	return false, nil
+}
+
+func webhookBlockWriter() (io.Writer, func()) {
+	zlog.Info("Posting records to webhook", zap.String("url", *flagWebhookURL), zap.Int("batch_size", *flagWebhookBatchSize))
+
+	webhook := newWebhookWriter(*flagWebhookURL, *flagWebhookBatchSize)
+	return webhook, webhook.flush
+}
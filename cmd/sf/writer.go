@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfuse-io/jsonpb"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/proto"
+	pbcodec "github.com/streamingfast/streamingfast-client/pb/dfuse/ethereum/codec/v1"
+	"go.uber.org/zap"
+)
+
+var endOfLine = []byte("\n")
+
+// outputAppendOffset is the size the output file had when opened with --append,
+// only what is written past it is verified at the end of the run
+var outputAppendOffset int64
+
+// recordSequence is the sequence number of the last record written, records
+// being prefixed with their sequence number when --sequence is set
+var recordSequence uint64
+
+// outputTime is the time the current output file was opened at, replacing the
+// `{time}` placeholder of its path, updated on each --rotate-interval rotation
+var outputTime = time.Now()
+
+// writeLimiter, when set, throttles the rate at which records are written
+var writeLimiter *tokenBucket
+
+var delimiters = map[string][]byte{
+	"lf":   []byte("\n"),
+	"crlf": []byte("\r\n"),
+	"nul":  {0},
+}
+
+// undoRecord is written in place of the block when a STEP_UNDO notification
+// is received, signaling consumers that everything previously written for
+// this block must be reverted.
+type undoRecord struct {
+	Undo     bool   `json:"undo"`
+	Step     string `json:"step"`
+	Cursor   string `json:"cursor"`
+	BlockID  string `json:"block_id"`
+	BlockNum uint64 `json:"block_num"`
+}
+
+// heartbeatRecord is periodically written when --heartbeat is set, signaling
+// consumers that the stream is healthy even if no block matched recently.
+type heartbeatRecord struct {
+	Heartbeat bool   `json:"heartbeat"`
+	Time      string `json:"time"`
+	Cursor    string `json:"cursor"`
+	BlockID   string `json:"block_id"`
+	BlockNum  uint64 `json:"block_num"`
+}
+
+// trxRecord is written for each transaction trace of the block when using
+// `--format trx-json`, the trace being the JSON encoded `TransactionTrace`.
+// The trx_index is the position of the transaction in the on-chain block, not
+// among the transactions that matched the filter, and status is the lower case
+// trace status, one of `succeeded`, `failed`, `reverted` or `unknown`. With
+// `--annotate-contracts`, accounts maps each address of the calls to its kind.
+type trxRecord struct {
+	Step     string          `json:"step"`
+	Cursor   string          `json:"cursor"`
+	BlockID  string          `json:"block_id"`
+	BlockNum uint64          `json:"block_num"`
+	TrxIndex uint32          `json:"trx_index"`
+	Status   string          `json:"status"`
+	Trx      json.RawMessage `json:"trx"`
+
+	Accounts map[string]string `json:"accounts,omitempty"`
+}
+
+// writeTransactions writes one record per transaction trace of the block and
+// returns the number of records written, on STEP_UNDO a single undo record is
+// written for the whole block.
+func writeTransactions(writer io.Writer, response *pbbstream.BlockResponseV2, block *pbcodec.Block) int {
+	if response.Step == pbbstream.ForkStep_STEP_UNDO {
+		writeRecord(writer, undoRecord{true, response.Step.String(), response.Cursor, block.ID(), block.Number}, block)
+		return 1
+	}
+
+	var kinds map[string]string
+	if *flagAnnotateContracts {
+		kinds = accountKinds(block)
+	}
+
+	for _, trxTrace := range block.TransactionTraces {
+		trx, err := jsonpb.MarshalToString(trxTrace)
+		noError(err, "unable to marshal block %s transaction %x to JSON", block.AsRef(), trxTrace.Hash)
+
+		record := trxRecord{response.Step.String(), response.Cursor, block.ID(), block.Number, trxTrace.Index, strings.ToLower(trxTrace.Status.String()), json.RawMessage(trx), nil}
+		if kinds != nil {
+			record.Accounts = transactionAccountKinds(trxTrace, kinds)
+		}
+
+		writeRecord(writer, record, block)
+	}
+
+	return len(block.TransactionTraces)
+}
+
+// storageChangeRecord is written for each storage slot change of the calls of
+// the block when using `--format storage-changes`, values being hex encoded.
+// Changes of calls whose state was reverted are not recorded on chain and are
+// skipped.
+type storageChangeRecord struct {
+	Step      string `json:"step"`
+	Cursor    string `json:"cursor"`
+	BlockID   string `json:"block_id"`
+	BlockNum  uint64 `json:"block_num"`
+	TrxHash   string `json:"trx_hash"`
+	TrxIndex  uint32 `json:"trx_index"`
+	CallIndex uint32 `json:"call_index"`
+	Address   string `json:"address"`
+	Key       string `json:"key"`
+	OldValue  string `json:"old_value"`
+	NewValue  string `json:"new_value"`
+}
+
+// writeStorageChanges writes one record per storage change of each call of
+// the block and returns the number of records written, on STEP_UNDO a single
+// undo record is written for the whole block.
+func writeStorageChanges(writer io.Writer, response *pbbstream.BlockResponseV2, block *pbcodec.Block) (count int) {
+	if response.Step == pbbstream.ForkStep_STEP_UNDO {
+		writeRecord(writer, undoRecord{true, response.Step.String(), response.Cursor, block.ID(), block.Number}, block)
+		return 1
+	}
+
+	for _, trxTrace := range block.TransactionTraces {
+		for _, call := range trxTrace.Calls {
+			if call.StateReverted {
+				continue
+			}
+
+			for _, change := range call.StorageChanges {
+				writeRecord(writer, storageChangeRecord{
+					Step:      response.Step.String(),
+					Cursor:    response.Cursor,
+					BlockID:   block.ID(),
+					BlockNum:  block.Number,
+					TrxHash:   "0x" + hex.EncodeToString(trxTrace.Hash),
+					TrxIndex:  trxTrace.Index,
+					CallIndex: call.Index,
+					Address:   "0x" + hex.EncodeToString(change.Address),
+					Key:       "0x" + hex.EncodeToString(change.Key),
+					OldValue:  "0x" + hex.EncodeToString(change.OldValue),
+					NewValue:  "0x" + hex.EncodeToString(change.NewValue),
+				}, block)
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// nativeTransferRecord is written for each call of the block transferring a
+// non-zero amount of the chain's native currency when using
+// `--format native-transfers`, value being the amount in wei as a decimal
+// string. With `--annotate-contracts`, from_kind and to_kind are the kinds of
+// the from and to addresses.
+type nativeTransferRecord struct {
+	Step      string `json:"step"`
+	Cursor    string `json:"cursor"`
+	BlockID   string `json:"block_id"`
+	BlockNum  uint64 `json:"block_num"`
+	TrxHash   string `json:"trx_hash"`
+	TrxIndex  uint32 `json:"trx_index"`
+	CallIndex uint32 `json:"call_index"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Value     string `json:"value"`
+	FromKind  string `json:"from_kind,omitempty"`
+	ToKind    string `json:"to_kind,omitempty"`
+}
+
+// writeNativeTransfers writes one record per call of the block with a
+// non-zero value and returns the number of records written, calls whose state
+// was reverted did not transfer anything and are skipped. On STEP_UNDO a
+// single undo record is written for the whole block.
+func writeNativeTransfers(writer io.Writer, response *pbbstream.BlockResponseV2, block *pbcodec.Block) (count int) {
+	if response.Step == pbbstream.ForkStep_STEP_UNDO {
+		writeRecord(writer, undoRecord{true, response.Step.String(), response.Cursor, block.ID(), block.Number}, block)
+		return 1
+	}
+
+	var kinds map[string]string
+	if *flagAnnotateContracts {
+		kinds = accountKinds(block)
+	}
+
+	for _, trxTrace := range block.TransactionTraces {
+		for _, call := range trxTrace.Calls {
+			if call.StateReverted || call.Value == nil {
+				continue
+			}
+
+			value := new(big.Int).SetBytes(call.Value.Bytes)
+			if value.Sign() == 0 {
+				continue
+			}
+
+			record := nativeTransferRecord{
+				Step:      response.Step.String(),
+				Cursor:    response.Cursor,
+				BlockID:   block.ID(),
+				BlockNum:  block.Number,
+				TrxHash:   "0x" + hex.EncodeToString(trxTrace.Hash),
+				TrxIndex:  trxTrace.Index,
+				CallIndex: call.Index,
+				From:      "0x" + hex.EncodeToString(call.Caller),
+				To:        "0x" + hex.EncodeToString(call.Address),
+				Value:     value.String(),
+			}
+			if kinds != nil {
+				record.FromKind = kinds[record.From]
+				record.ToKind = kinds[record.To]
+			}
+
+			writeRecord(writer, record, block)
+			count++
+		}
+	}
+
+	return count
+}
+
+// writeHeader writes the block's number, ID and timestamp as a single text
+// line, followed by the fork step when fork notifications are requested.
+func writeHeader(writer io.Writer, response *pbbstream.BlockResponseV2, block *pbcodec.Block) {
+	line := strconv.FormatUint(block.Number, 10) + " " + block.ID() + " " + blockTime(block)
+	if *flagHandleForks {
+		line += " " + response.Step.String()
+	}
+
+	writeLine(writer, line, block)
+}
+
+// writeProtoStream writes each transaction trace of the block as its protobuf
+// binary encoding prefixed by the encoding's length as a varint and returns the
+// number of traces written, the traces being the ones left by the transforms.
+func writeProtoStream(writer io.Writer, block *pbcodec.Block) int {
+	for _, trxTrace := range block.TransactionTraces {
+		data, err := proto.Marshal(trxTrace)
+		noError(err, "unable to marshal block %s transaction %x to protobuf", block.AsRef(), trxTrace.Hash)
+
+		if writeLimiter != nil {
+			writeLimiter.wait()
+		}
+
+		_, err = writer.Write(append(proto.EncodeVarint(uint64(len(data))), data...))
+		noErrorWithCode(exitOutput, err, "unable to write block %s transaction %x message", block.AsRef(), trxTrace.Hash)
+	}
+
+	return len(block.TransactionTraces)
+}
+
+func writeHeartbeat(writer io.Writer, block *pbcodec.Block, cursor string) {
+	writeRecord(writer, heartbeatRecord{true, time.Now().UTC().Format(time.RFC3339), cursor, block.ID(), block.Number}, block)
+}
+
+func writeRecord(writer io.Writer, record interface{}, block *pbcodec.Block) {
+	var data []byte
+	var err error
+	if *flagPretty {
+		data, err = json.MarshalIndent(record, "", "  ")
+	} else {
+		data, err = json.Marshal(record)
+	}
+	noError(err, "unable to marshal block %s record to JSON", block.AsRef())
+
+	writeLine(writer, string(data), block)
+}
+
+func writeBlock(writer io.Writer, response *pbbstream.BlockResponseV2, block *pbcodec.Block) {
+	var line string
+	var err error
+	switch {
+	case response.Step == pbbstream.ForkStep_STEP_UNDO:
+		writeRecord(writer, undoRecord{true, response.Step.String(), response.Cursor, block.ID(), block.Number}, block)
+		return
+	case *flagPretty:
+		line, err = jsonpb.MarshalIndentToString(response, "  ")
+	default:
+		line, err = jsonpb.MarshalToString(response)
+	}
+	noError(err, "unable to marshal block %s to JSON", block.AsRef())
+
+	writeLine(writer, line, block)
+}
+
+func writeLine(writer io.Writer, line string, block *pbcodec.Block) {
+	if writeLimiter != nil {
+		writeLimiter.wait()
+	}
+
+	if *flagSequence {
+		recordSequence++
+		line = strconv.FormatUint(recordSequence, 10) + "\t" + line
+	}
+
+	_, err := writer.Write([]byte(line))
+	noErrorWithCode(exitOutput, err, "unable to write block %s line to JSON", block.AsRef())
+
+	_, err = writer.Write(endOfLine)
+	noErrorWithCode(exitOutput, err, "unable to write block %s line ending", block.AsRef())
+
+	if webhook, ok := writer.(*webhookWriter); ok {
+		webhook.recordWritten()
+	}
+
+	if pubsub, ok := writer.(*pubsubWriter); ok {
+		pubsub.recordWritten(block)
+	}
+}
+
+// writeBlockFile writes the block in its own `<dir>/<block_number>.json` file,
+// blocks without any matching transactions are skipped and no file is created
+// for them. On STEP_UNDO, the block's file is removed instead.
+func writeBlockFile(dir string, response *pbbstream.BlockResponseV2, block *pbcodec.Block) {
+	out := filepath.Join(dir, strconv.FormatUint(block.Number, 10)+".json")
+	if response.Step == pbbstream.ForkStep_STEP_UNDO {
+		if err := os.Remove(out); err != nil && !os.IsNotExist(err) {
+			noErrorWithCode(exitOutput, err, "unable to remove undone block file %q", out)
+		}
+		return
+	}
+
+	if len(block.TransactionTraces) == 0 {
+		return
+	}
+
+	file, err := os.Create(out)
+	noErrorWithCode(exitOutput, err, "unable to create file %q", out)
+	defer file.Close()
+
+	writeBlock(file, response, block)
+}
+
+// blockFileDir returns the directory where each block is written in its own file
+// when --split-by-block is set, empty otherwise.
+func blockFileDir(bRange blockRange) string {
+	if !*flagSplitByBlock || *flagSummaryOnly {
+		return ""
+	}
+
+	dir := outputPath(bRange)
+	ensure(dir != "" && dir != "-", "the -o flag must be set to a directory when --split-by-block is used")
+	noErrorWithCode(exitOutput, os.MkdirAll(dir, os.ModePerm), "unable to create directories %q", dir)
+
+	return dir
+}
+
+func blockWriter(bRange blockRange) (io.Writer, func()) {
+	if *flagSplitByBlock || *flagSummaryOnly {
+		return nil, func() {}
+	}
+
+	if *flagS3Bucket != "" {
+		return s3BlockWriter(bRange)
+	}
+
+	if *flagWebhookURL != "" {
+		return webhookBlockWriter()
+	}
+
+	if *flagPubsubProject != "" {
+		return pubsubBlockWriter()
+	}
+
+	out := outputPath(bRange)
+	if out == "" {
+		return nil, func() {}
+	}
+
+	if out == "-" {
+		stat, err := os.Stdout.Stat()
+		interactive := err == nil && (stat.Mode()&os.ModeCharDevice) != 0
+
+		return withBuffering(os.Stdout, interactive, func() {})
+	}
+
+	dir := filepath.Dir(out)
+	noErrorWithCode(exitOutput, os.MkdirAll(dir, os.ModePerm), "unable to create directories %q", dir)
+
+	if *flagAppend {
+		file, err := os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		noErrorWithCode(exitOutput, err, "unable to open file %q for appending", out)
+
+		info, err := file.Stat()
+		noErrorWithCode(exitOutput, err, "unable to stat file %q", out)
+		outputAppendOffset = info.Size()
+		zlog.Info("Appending to existing output file", zap.String("path", out), zap.Int64("size", outputAppendOffset))
+
+		return withBuffering(file, false, func() { file.Close() })
+	}
+
+	file, err := os.Create(out)
+	noErrorWithCode(exitOutput, err, "unable to create file %q", out)
+
+	return withBuffering(file, false, func() { file.Close() })
+}
+
+func outputPath(bRange blockRange) string {
+	if flagWrite == nil || strings.TrimSpace(*flagWrite) == "" {
+		return ""
+	}
+
+	return withTime(withRange(strings.TrimSpace(*flagWrite), bRange), outputTime)
+}
+
+// outputTimeLayout is the layout of the `{time}` placeholder, sortable and
+// free of characters that are not allowed in file names
+const outputTimeLayout = "20060102T150405Z"
+
+// withTime replaces the `{time}` placeholder of template by the UTC time t
+func withTime(template string, t time.Time) string {
+	return strings.Replace(template, "{time}", t.UTC().Format(outputTimeLayout), 1)
+}
+
+// withRange replaces the `{range}` placeholder of template by the block range
+func withRange(template string, bRange blockRange) string {
+	return strings.Replace(template, "{range}", strings.ReplaceAll(bRange.String(), " ", ""), 1)
+}
+
+// withBuffering wraps the writer in a buffered writer when either --buffer-size
+// or --flush-every is set, the output being unbuffered otherwise. Interactive
+// outputs (a terminal) are flushed after each block unless --flush-every says
+// otherwise.
+func withBuffering(writer io.Writer, interactive bool, closer func()) (io.Writer, func()) {
+	policy := newFlushPolicy(*flagFlushEvery)
+	if *flagBufferSize <= 0 && !policy.enabled() {
+		return writer, closer
+	}
+
+	if interactive && !policy.enabled() {
+		policy.blocks = 1
+	}
+
+	size := *flagBufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+
+	flushing := &flushingWriter{Writer: bufio.NewWriterSize(writer, size), policy: policy, lastFlush: time.Now()}
+	return flushing, func() {
+		if err := flushing.Flush(); err != nil {
+			zlog.Warn("unable to flush buffered blocks", zap.Error(err))
+		}
+		closer()
+	}
+}
+
+const defaultBufferSize = 4096
+
+// flushPolicy controls how often buffered output is flushed, either after a
+// given count of blocks or once a given duration elapsed since the last flush.
+type flushPolicy struct {
+	blocks   uint64
+	interval time.Duration
+}
+
+func newFlushPolicy(in string) (out flushPolicy) {
+	in = strings.TrimSpace(in)
+	switch {
+	case in == "":
+	case in == "block":
+		out.blocks = 1
+	case isUint(in):
+		out.blocks, _ = strconv.ParseUint(in, 10, 64)
+		ensure(out.blocks > 0, "the --flush-every block count must be greater than 0")
+	default:
+		interval, err := time.ParseDuration(in)
+		ensure(err == nil && interval > 0, "the --flush-every value %q is neither a valid block count nor a valid duration", in)
+		out.interval = interval
+	}
+	return
+}
+
+func (p flushPolicy) enabled() bool {
+	return p.blocks > 0 || p.interval > 0
+}
+
+type flushingWriter struct {
+	*bufio.Writer
+	policy flushPolicy
+
+	pendingBlocks uint64
+	lastFlush     time.Time
+}
+
+// blockWritten must be called once a full block has been written, it flushes
+// the buffered data if the flush policy says so.
+func (w *flushingWriter) blockWritten() error {
+	w.pendingBlocks++
+
+	switch {
+	case w.policy.blocks > 0 && w.pendingBlocks < w.policy.blocks:
+		return nil
+	case w.policy.interval > 0 && time.Since(w.lastFlush) < w.policy.interval:
+		return nil
+	}
+
+	return w.flush()
+}
+
+func (w *flushingWriter) flush() error {
+	w.pendingBlocks = 0
+	w.lastFlush = time.Now()
+	return w.Flush()
+}
+
+// flushOutput flushes the writer if it's buffered, no-op otherwise.
+func flushOutput(writer io.Writer) {
+	if flushing, ok := writer.(*flushingWriter); ok {
+		noErrorWithCode(exitOutput, flushing.flush(), "unable to flush output")
+	}
+
+	if pubsub, ok := writer.(*pubsubWriter); ok {
+		pubsub.flush()
+	}
+}
+
+// closeWithin runs the output closer, giving up and exiting the process if it
+// did not complete within timeout, a zero timeout waits forever.
+func closeWithin(closer func(), timeout time.Duration) {
+	if timeout <= 0 {
+		closer()
+		return
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		closer()
+	}()
+
+	select {
+	case <-done:
+		zlog.Debug("Output flushed and closed", zap.Duration("elapsed", time.Since(start)))
+	case <-time.After(timeout):
+		zlog.Warn("Output did not complete flushing and closing in time, some blocks might not have been written", zap.Duration("timeout", timeout))
+		quitWithCode(exitOutput, "Unable to close output within --shutdown-timeout %s", timeout)
+	}
+}
+
+// lastRecordBlockNum reads the block number of the last record of the output
+// file at path, found being false when the file does not exist or is empty.
+// Records are either JSON, a `block_num` field or the `block.number` of whole
+// blocks, or header lines starting with the number.
+func lastRecordBlockNum(path string) (num uint64, found bool, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	end := info.Size()
+	if end == 0 {
+		return 0, false, nil
+	}
+
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, end-1); err != nil {
+		return 0, false, err
+	}
+	if last[0] != endOfLine[len(endOfLine)-1] {
+		return 0, false, fmt.Errorf("file ends with a partial record, it must be truncated up to its last complete record first")
+	}
+
+	// Looks backward for the line ending preceding the last record
+	start := int64(0)
+	chunk := make([]byte, 64*1024)
+	for offset := end - 1; offset > 0 && start == 0; {
+		size := int64(len(chunk))
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+
+		if _, err := file.ReadAt(chunk[:size], offset); err != nil {
+			return 0, false, err
+		}
+		if i := bytes.LastIndexByte(chunk[:size], last[0]); i != -1 {
+			start = offset + int64(i) + 1
+		}
+	}
+
+	line := make([]byte, end-start)
+	if _, err := file.ReadAt(line, start); err != nil {
+		return 0, false, err
+	}
+	// The delimiter may not be whitespace, 'nul' being the zero byte
+	line = bytes.TrimSpace(bytes.TrimSuffix(line, endOfLine))
+
+	if *flagSequence {
+		if i := bytes.IndexByte(line, '\t'); i != -1 {
+			line = line[i+1:]
+		}
+	}
+
+	if bytes.HasPrefix(line, []byte("{")) {
+		var record struct {
+			BlockNum *uint64 `json:"block_num"`
+			Block    *struct {
+				Number json.Number `json:"number"`
+			} `json:"block"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return 0, false, fmt.Errorf("last record is not valid JSON: %w", err)
+		}
+
+		switch {
+		case record.BlockNum != nil:
+			return *record.BlockNum, true, nil
+		case record.Block != nil && record.Block.Number != "":
+			num, err := strconv.ParseUint(string(record.Block.Number), 10, 64)
+			return num, err == nil, err
+		}
+		return 0, false, fmt.Errorf("last record has no block number")
+	}
+
+	num, err = strconv.ParseUint(string(bytes.SplitN(line, []byte(" "), 2)[0]), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("last record does not start with a block number: %w", err)
+	}
+	return num, true, nil
+}
+
+// verifyRecordCount counts the records of the output file and logs a warning
+// if it does not match the number of records written, which would indicate
+// that the output was truncated or corrupted.
+func verifyRecordCount(path string, expected uint64) {
+	file, err := os.Open(path)
+	if err != nil {
+		zlog.Warn("Unable to open output file for verification", zap.String("path", path), zap.Error(err))
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(outputAppendOffset, io.SeekStart); err != nil {
+		zlog.Warn("Unable to seek output file for verification", zap.String("path", path), zap.Error(err))
+		return
+	}
+
+	// Written records never contain the delimiter's last byte so counting it is enough
+	delimiter := endOfLine[len(endOfLine)-1]
+
+	var count uint64
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	for {
+		chunk, err := reader.ReadSlice(delimiter)
+		if err == nil {
+			count++
+			continue
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != io.EOF {
+			zlog.Warn("Unable to read output file for verification", zap.String("path", path), zap.Error(err))
+			return
+		}
+
+		if len(chunk) > 0 {
+			zlog.Warn("Output file ends with a partial record", zap.String("path", path))
+		}
+		break
+	}
+
+	if count != expected {
+		zlog.Warn("Output file record count does not match the number of records written, output might be truncated or corrupted", zap.String("path", path), zap.Uint64("file_records", count), zap.Uint64("written_records", expected))
+		return
+	}
+
+	zlog.Info("Output file verified", zap.String("path", path), zap.Uint64("records", count))
+}